@@ -3,6 +3,7 @@ package cache
 import (
 	"context"
 	"emailnotifl3n/app/config"
+	"strconv"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -25,7 +26,12 @@ type redisClient struct {
 
 type Redis interface {
 	Set(ctx context.Context, key string, value string) error
+	SetWithExpiration(ctx context.Context, key string, value string, expiration time.Duration) error
+	SetIfNotExists(ctx context.Context, key string, value string, expiration time.Duration) (bool, error)
+	Increment(ctx context.Context, key string, expiration time.Duration) (int64, error)
+	AllowRequest(ctx context.Context, key string, limit int, window time.Duration) (bool, time.Duration, error)
 	Get(ctx context.Context, key string) (string, error)
+	GetDelete(ctx context.Context, key string) (string, error)
 	Delete(ctx context.Context, key string) error
 }
 
@@ -34,6 +40,61 @@ func (c *redisClient) Set(ctx context.Context, key string, value string) error {
 	return err
 }
 
+func (c *redisClient) SetWithExpiration(ctx context.Context, key string, value string, expiration time.Duration) error {
+	err := c.rdb.Set(ctx, key, value, expiration).Err()
+	return err
+}
+
+func (c *redisClient) SetIfNotExists(ctx context.Context, key string, value string, expiration time.Duration) (bool, error) {
+	ok, err := c.rdb.SetNX(ctx, key, value, expiration).Result()
+	return ok, err
+}
+
+// Increment adds one to the counter at key and (re)starts its expiration
+func (c *redisClient) Increment(ctx context.Context, key string, expiration time.Duration) (int64, error) {
+	var incr *redis.IntCmd
+	_, err := c.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, expiration)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// sliding window log, every allowed request is a member of a sorted set scored by its time
+var allowRequestScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+if redis.call('ZCARD', KEYS[1]) < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	redis.call('PEXPIRE', KEYS[1], window)
+	return 0
+end
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+return tonumber(oldest[2]) + window - now
+`)
+
+// AllowRequest records a request at key unless limit requests were already made
+// within window, in which case it returns how long until the next one is allowed
+func (c *redisClient) AllowRequest(ctx context.Context, key string, limit int, window time.Duration) (bool, time.Duration, error) {
+	now := time.Now()
+	member := strconv.FormatInt(now.UnixNano(), 10)
+	wait, err := allowRequestScript.Run(ctx, c.rdb, []string{key},
+		now.UnixMilli(), window.Milliseconds(), limit, member).Int64()
+	if err != nil {
+		return false, 0, err
+	}
+	if wait <= 0 {
+		return true, 0, nil
+	}
+	return false, time.Duration(wait) * time.Millisecond, nil
+}
+
 func (c *redisClient) Get(ctx context.Context, key string) (string, error) {
 	val, err := c.rdb.Get(ctx, key).Result()
 	if err != nil {
@@ -43,6 +104,15 @@ func (c *redisClient) Get(ctx context.Context, key string) (string, error) {
 	return val, nil
 }
 
+func (c *redisClient) GetDelete(ctx context.Context, key string) (string, error) {
+	val, err := c.rdb.GetDel(ctx, key).Result()
+	if err != nil {
+		return "", err
+	}
+
+	return val, nil
+}
+
 func (c *redisClient) Delete(ctx context.Context, key string) error {
 	err := c.rdb.Del(ctx, key).Err()
 	return err
@@ -5,12 +5,14 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 var (
 	JWT_SECRET            string
+	JWT_KEYS              []string
 	RDS_URL               string
 	AWS_ACCESS_KEY_ID     string
 	AWS_SECRET_ACCESS_KEY string
@@ -23,6 +25,9 @@ var (
 	CLIENT_SECRET_FB      string
 	FB_URL                string
 	SCOPES_FB             []string
+	WEBAUTHN_RP_ID        string
+	WEBAUTHN_RP_NAME      string
+	WEBAUTHN_ORIGINS      []string
 )
 
 type AppConfig struct {
@@ -37,6 +42,46 @@ type AppConfig struct {
 	SMTP_PASS   string
 	PASSWD_URL  string
 	EMAIL_FROM  string
+	// failed logins per account before it is locked
+	LOCKOUT_THRESHOLD int
+	// failed logins per ip before it is locked
+	LOCKOUT_IP_THRESHOLD int
+	LOCKOUT_DURATION     time.Duration
+	// first delay after a failed login, doubled on every further failure
+	LOCKOUT_DELAY time.Duration
+	// wrong guesses before a 6-digit code is burned
+	CODE_MAX_ATTEMPTS int
+	// answer email based requests alike whether the email is registered or not
+	ANTI_ENUMERATION bool
+	// mail unknown addresses that someone asked for a reset or code
+	UNKNOWN_EMAIL_NOTICE bool
+	// algorithm of new password hashes: bcrypt, argon2id or scrypt
+	HASH_ALGORITHM string
+	BCRYPT_COST    int
+	// argon2id memory is in KiB
+	ARGON2_TIME    int
+	ARGON2_MEMORY  int
+	ARGON2_THREADS int
+	SCRYPT_N       int
+	SCRYPT_R       int
+	SCRYPT_P       int
+	// password policy, zero disables a numeric rule
+	PASSWORD_MIN_LENGTH     int
+	PASSWORD_MIN_CLASSES    int
+	PASSWORD_CHECK_PERSONAL bool
+	PASSWORD_MIN_SCORE      int
+	// bloom filter of breached passwords built with cmd/breachfilter, empty disables the check
+	BREACH_FILTER string
+	// number of recent passwords, the current one included, that cannot be reused, zero disables the check
+	PASSWORD_HISTORY int
+	// how long an oauth redirect may take to come back, and where the frontend may ask to land after it
+	OAUTH_STATE_TTL     time.Duration
+	OAUTH_REDIRECT_URIS []string
+	// link a provider account to the user with the same email when the provider verified it,
+	// otherwise the owner proves ownership with the password or an emailed code first
+	OAUTH_AUTO_LINK bool
+	// CIDR ranges of the reverse proxies allowed to set X-Forwarded-For, empty trusts no header
+	TRUSTED_PROXIES []string
 }
 
 func InitConfig() *AppConfig {
@@ -44,7 +89,30 @@ func InitConfig() *AppConfig {
 }
 
 func ReadEnv() *AppConfig {
-	app := AppConfig{}
+	app := AppConfig{
+		LOCKOUT_THRESHOLD:    5,
+		LOCKOUT_IP_THRESHOLD: 20,
+		LOCKOUT_DURATION:     15 * time.Minute,
+		LOCKOUT_DELAY:        time.Second,
+		CODE_MAX_ATTEMPTS:    5,
+		ANTI_ENUMERATION:     true,
+		HASH_ALGORITHM:       "bcrypt",
+		BCRYPT_COST:          10,
+		ARGON2_TIME:          2,
+		ARGON2_MEMORY:        19 * 1024,
+		ARGON2_THREADS:       1,
+		SCRYPT_N:             32768,
+		SCRYPT_R:             8,
+		SCRYPT_P:             1,
+
+		PASSWORD_MIN_LENGTH:     8,
+		PASSWORD_MIN_CLASSES:    2,
+		PASSWORD_CHECK_PERSONAL: true,
+		PASSWORD_MIN_SCORE:      2,
+		PASSWORD_HISTORY:        5,
+
+		OAUTH_STATE_TTL: 10 * time.Minute,
+	}
 	isRead := true
 
 	if val, found := os.LookupEnv("DBUSER"); found {
@@ -72,6 +140,10 @@ func ReadEnv() *AppConfig {
 		JWT_SECRET = val
 		isRead = false
 	}
+	if val, found := os.LookupEnv("JWTKEYS"); found {
+		JWT_KEYS = strings.Split(val, ",")
+		isRead = false
+	}
 	if val, found := os.LookupEnv("RDSURL"); found {
 		RDS_URL = val
 		isRead = false
@@ -113,6 +185,127 @@ func ReadEnv() *AppConfig {
 		app.EMAIL_FROM = val
 		isRead = false
 	}
+	if val, found := os.LookupEnv("LOCKOUTTHRESHOLD"); found {
+		cnv, _ := strconv.Atoi(val)
+		app.LOCKOUT_THRESHOLD = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("LOCKOUTIPTHRESHOLD"); found {
+		cnv, _ := strconv.Atoi(val)
+		app.LOCKOUT_IP_THRESHOLD = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("LOCKOUTDURATION"); found {
+		cnv, _ := time.ParseDuration(val)
+		app.LOCKOUT_DURATION = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("LOCKOUTDELAY"); found {
+		cnv, _ := time.ParseDuration(val)
+		app.LOCKOUT_DELAY = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("CODEMAXATTEMPTS"); found {
+		cnv, _ := strconv.Atoi(val)
+		app.CODE_MAX_ATTEMPTS = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("ANTIENUMERATION"); found {
+		cnv, _ := strconv.ParseBool(val)
+		app.ANTI_ENUMERATION = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("UNKNOWNEMAILNOTICE"); found {
+		cnv, _ := strconv.ParseBool(val)
+		app.UNKNOWN_EMAIL_NOTICE = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("HASHALGORITHM"); found {
+		app.HASH_ALGORITHM = val
+		isRead = false
+	}
+	if val, found := os.LookupEnv("BCRYPTCOST"); found {
+		cnv, _ := strconv.Atoi(val)
+		app.BCRYPT_COST = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("ARGON2TIME"); found {
+		cnv, _ := strconv.Atoi(val)
+		app.ARGON2_TIME = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("ARGON2MEMORY"); found {
+		cnv, _ := strconv.Atoi(val)
+		app.ARGON2_MEMORY = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("ARGON2THREADS"); found {
+		cnv, _ := strconv.Atoi(val)
+		app.ARGON2_THREADS = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("SCRYPTN"); found {
+		cnv, _ := strconv.Atoi(val)
+		app.SCRYPT_N = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("SCRYPTR"); found {
+		cnv, _ := strconv.Atoi(val)
+		app.SCRYPT_R = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("SCRYPTP"); found {
+		cnv, _ := strconv.Atoi(val)
+		app.SCRYPT_P = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("PASSWORDMINLENGTH"); found {
+		cnv, _ := strconv.Atoi(val)
+		app.PASSWORD_MIN_LENGTH = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("PASSWORDMINCLASSES"); found {
+		cnv, _ := strconv.Atoi(val)
+		app.PASSWORD_MIN_CLASSES = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("PASSWORDCHECKPERSONAL"); found {
+		cnv, _ := strconv.ParseBool(val)
+		app.PASSWORD_CHECK_PERSONAL = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("PASSWORDMINSCORE"); found {
+		cnv, _ := strconv.Atoi(val)
+		app.PASSWORD_MIN_SCORE = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("BREACHFILTER"); found {
+		app.BREACH_FILTER = val
+		isRead = false
+	}
+	if val, found := os.LookupEnv("PASSWORDHISTORY"); found {
+		cnv, _ := strconv.Atoi(val)
+		app.PASSWORD_HISTORY = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("OAUTHSTATETTL"); found {
+		cnv, _ := time.ParseDuration(val)
+		app.OAUTH_STATE_TTL = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("OAUTHREDIRECTURIS"); found {
+		app.OAUTH_REDIRECT_URIS = strings.Split(val, ",")
+		isRead = false
+	}
+	if val, found := os.LookupEnv("OAUTHAUTOLINK"); found {
+		cnv, _ := strconv.ParseBool(val)
+		app.OAUTH_AUTO_LINK = cnv
+		isRead = false
+	}
+	if val, found := os.LookupEnv("TRUSTEDPROXIES"); found {
+		app.TRUSTED_PROXIES = strings.Split(val, ",")
+		isRead = false
+	}
 	if val, found := os.LookupEnv("CLIENTID"); found {
 		CLIENT_ID = val
 		isRead = false
@@ -145,17 +338,54 @@ func ReadEnv() *AppConfig {
 		SCOPES_FB = strings.Split(val, ",")
 		isRead = false
 	}
+	if val, found := os.LookupEnv("WEBAUTHNRPID"); found {
+		WEBAUTHN_RP_ID = val
+		isRead = false
+	}
+	if val, found := os.LookupEnv("WEBAUTHNRPNAME"); found {
+		WEBAUTHN_RP_NAME = val
+		isRead = false
+	}
+	if val, found := os.LookupEnv("WEBAUTHNORIGINS"); found {
+		WEBAUTHN_ORIGINS = strings.Split(val, ",")
+		isRead = false
+	}
 
 	if isRead {
 		viper.AddConfigPath(".")
 		viper.SetConfigName("local")
 		viper.SetConfigType("env")
+		viper.SetDefault("LOCKOUTTHRESHOLD", app.LOCKOUT_THRESHOLD)
+		viper.SetDefault("LOCKOUTIPTHRESHOLD", app.LOCKOUT_IP_THRESHOLD)
+		viper.SetDefault("LOCKOUTDURATION", app.LOCKOUT_DURATION)
+		viper.SetDefault("LOCKOUTDELAY", app.LOCKOUT_DELAY)
+		viper.SetDefault("CODEMAXATTEMPTS", app.CODE_MAX_ATTEMPTS)
+		viper.SetDefault("ANTIENUMERATION", app.ANTI_ENUMERATION)
+		viper.SetDefault("UNKNOWNEMAILNOTICE", app.UNKNOWN_EMAIL_NOTICE)
+		viper.SetDefault("HASHALGORITHM", app.HASH_ALGORITHM)
+		viper.SetDefault("BCRYPTCOST", app.BCRYPT_COST)
+		viper.SetDefault("ARGON2TIME", app.ARGON2_TIME)
+		viper.SetDefault("ARGON2MEMORY", app.ARGON2_MEMORY)
+		viper.SetDefault("ARGON2THREADS", app.ARGON2_THREADS)
+		viper.SetDefault("SCRYPTN", app.SCRYPT_N)
+		viper.SetDefault("SCRYPTR", app.SCRYPT_R)
+		viper.SetDefault("SCRYPTP", app.SCRYPT_P)
+		viper.SetDefault("PASSWORDMINLENGTH", app.PASSWORD_MIN_LENGTH)
+		viper.SetDefault("PASSWORDMINCLASSES", app.PASSWORD_MIN_CLASSES)
+		viper.SetDefault("PASSWORDCHECKPERSONAL", app.PASSWORD_CHECK_PERSONAL)
+		viper.SetDefault("PASSWORDMINSCORE", app.PASSWORD_MIN_SCORE)
+		viper.SetDefault("PASSWORDHISTORY", app.PASSWORD_HISTORY)
+		viper.SetDefault("OAUTHSTATETTL", app.OAUTH_STATE_TTL)
+		viper.SetDefault("OAUTHAUTOLINK", app.OAUTH_AUTO_LINK)
 
 		err := viper.ReadInConfig()
 		if err != nil {
 			log.Println("error read config : ", err.Error())
 			return nil
 		}
+		WEBAUTHN_RP_ID = viper.GetString("WEBAUTHNRPID")
+		WEBAUTHN_RP_NAME = viper.GetString("WEBAUTHNRPNAME")
+		WEBAUTHN_ORIGINS = strings.Split(viper.GetString("WEBAUTHNORIGINS"), ",")
 		SCOPES_FB = strings.Split(viper.GetString("SCOPESFB"), ",")
 		FB_URL = viper.GetString("FBURL")
 		CLIENT_ID_FB = viper.GetString("CLIENTIDFB")
@@ -169,12 +399,38 @@ func ReadEnv() *AppConfig {
 		AWS_REGION = viper.GetString("AWSREGION")
 		RDS_URL = viper.GetString("RDSURL")
 		JWT_SECRET = viper.GetString("JWTSECRET")
+		JWT_KEYS = strings.Split(viper.GetString("JWTKEYS"), ",")
 		app.SMTP_HOST = viper.GetString("SMTPHOST")
 		app.SMTP_PORT, _ = strconv.Atoi(viper.Get("SMTPPORT").(string))
 		app.SMTP_USER = viper.GetString("SMTPUSER")
 		app.SMTP_PASS = viper.GetString("SMTPPASS")
 		app.PASSWD_URL = viper.GetString("PASSWDURL")
 		app.EMAIL_FROM = viper.GetString("EMAILFROM")
+		app.LOCKOUT_THRESHOLD = viper.GetInt("LOCKOUTTHRESHOLD")
+		app.LOCKOUT_IP_THRESHOLD = viper.GetInt("LOCKOUTIPTHRESHOLD")
+		app.LOCKOUT_DURATION = viper.GetDuration("LOCKOUTDURATION")
+		app.LOCKOUT_DELAY = viper.GetDuration("LOCKOUTDELAY")
+		app.CODE_MAX_ATTEMPTS = viper.GetInt("CODEMAXATTEMPTS")
+		app.ANTI_ENUMERATION = viper.GetBool("ANTIENUMERATION")
+		app.UNKNOWN_EMAIL_NOTICE = viper.GetBool("UNKNOWNEMAILNOTICE")
+		app.HASH_ALGORITHM = viper.GetString("HASHALGORITHM")
+		app.BCRYPT_COST = viper.GetInt("BCRYPTCOST")
+		app.ARGON2_TIME = viper.GetInt("ARGON2TIME")
+		app.ARGON2_MEMORY = viper.GetInt("ARGON2MEMORY")
+		app.ARGON2_THREADS = viper.GetInt("ARGON2THREADS")
+		app.SCRYPT_N = viper.GetInt("SCRYPTN")
+		app.SCRYPT_R = viper.GetInt("SCRYPTR")
+		app.SCRYPT_P = viper.GetInt("SCRYPTP")
+		app.PASSWORD_MIN_LENGTH = viper.GetInt("PASSWORDMINLENGTH")
+		app.PASSWORD_MIN_CLASSES = viper.GetInt("PASSWORDMINCLASSES")
+		app.PASSWORD_CHECK_PERSONAL = viper.GetBool("PASSWORDCHECKPERSONAL")
+		app.PASSWORD_MIN_SCORE = viper.GetInt("PASSWORDMINSCORE")
+		app.BREACH_FILTER = viper.GetString("BREACHFILTER")
+		app.PASSWORD_HISTORY = viper.GetInt("PASSWORDHISTORY")
+		app.OAUTH_STATE_TTL = viper.GetDuration("OAUTHSTATETTL")
+		app.OAUTH_REDIRECT_URIS = strings.Split(viper.GetString("OAUTHREDIRECTURIS"), ",")
+		app.OAUTH_AUTO_LINK = viper.GetBool("OAUTHAUTOLINK")
+		app.TRUSTED_PROXIES = strings.Split(viper.GetString("TRUSTEDPROXIES"), ",")
 		app.DB_USERNAME = viper.Get("DBUSER").(string)
 		app.DB_PASSWORD = viper.Get("DBPASS").(string)
 		app.DB_HOSTNAME = viper.Get("DBHOST").(string)
@@ -21,6 +21,12 @@ func InitDBPostgres(cfg *config.AppConfig) *gorm.DB {
 
 	DB.AutoMigrate(
 		&ud.User{},
+		&ud.Session{},
+		&ud.RefreshToken{},
+		&ud.RecoveryCode{},
+		&ud.Passkey{},
+		&ud.PasswordHistory{},
+		&ud.UserIdentity{},
 	)
 
 	return DB
@@ -2,45 +2,118 @@ package router
 
 import (
 	"emailnotifl3n/app/cache"
+	"emailnotifl3n/app/config"
 	ud "emailnotifl3n/features/user/data"
 	uh "emailnotifl3n/features/user/handler"
 	us "emailnotifl3n/features/user/service"
+	"emailnotifl3n/utils/breach"
 	"emailnotifl3n/utils/email"
 	"emailnotifl3n/utils/encrypts"
 	"emailnotifl3n/utils/middlewares"
 	oauthfacebook "emailnotifl3n/utils/oauthFacebook"
 	"emailnotifl3n/utils/oauthGoogle"
+	"emailnotifl3n/utils/passwordpolicy"
 	"emailnotifl3n/utils/upload"
+	"emailnotifl3n/utils/webauthn"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"gorm.io/gorm"
 )
 
-func InitRouter(db *gorm.DB, e *echo.Echo, rds cache.Redis) {
-	hash := encrypts.New()
+func InitRouter(db *gorm.DB, e *echo.Echo, rds cache.Redis, cfg *config.AppConfig) {
+	hash := encrypts.New(cfg)
 	s3Uploader := upload.New()
 	email := email.New()
 	oauthGoogle := oauthGoogle.New()
 	oauthfacebook := oauthfacebook.New()
+	webauthn := webauthn.New()
+	passwordPolicy := passwordpolicy.New(cfg)
+	breachChecker := breach.New(cfg)
 
-	userData := ud.New(db, rds)
-	userService := us.New(userData, hash)
-	userHandlerAPI := uh.New(userService, s3Uploader, email, oauthGoogle, oauthfacebook)
+	userData := ud.New(db, rds, cfg)
+	userService := us.New(userData, hash, email, webauthn, passwordPolicy, breachChecker, cfg)
+	userHandlerAPI := uh.New(userService, s3Uploader, email, oauthGoogle, oauthfacebook, cfg)
+
+	// rate limit policies of the endpoints that check passwords or send emails
+	loginLimit := middlewares.RateLimit(rds,
+		middlewares.RateLimitPolicy{Name: "login:ip", Limit: 30, Window: time.Minute, Key: middlewares.KeyByIP},
+		middlewares.RateLimitPolicy{Name: "login:email", Limit: 10, Window: time.Minute, Key: middlewares.KeyByEmail},
+	)
+	emailLimit := middlewares.RateLimit(rds,
+		middlewares.RateLimitPolicy{Name: "email:ip", Limit: 20, Window: time.Hour, Key: middlewares.KeyByIP},
+		middlewares.RateLimitPolicy{Name: "email:email", Limit: 5, Window: time.Hour, Key: middlewares.KeyByEmail},
+	)
+	// one code per minute per address, a new code replaces the previous one
+	codeLimit := middlewares.RateLimit(rds,
+		middlewares.RateLimitPolicy{Name: "code:ip", Limit: 20, Window: time.Hour, Key: middlewares.KeyByIP},
+		middlewares.RateLimitPolicy{Name: "code:email", Limit: 1, Window: time.Minute, Key: middlewares.KeyByEmail},
+		middlewares.RateLimitPolicy{Name: "code:email:hour", Limit: 5, Window: time.Hour, Key: middlewares.KeyByEmail},
+	)
+	// the code goes to the account of the pending link, so it is limited per link as well,
+	// together with the attempts kept across resends this caps the guesses per link
+	linkCodeLimit := middlewares.RateLimit(rds,
+		middlewares.RateLimitPolicy{Name: "link-code:ip", Limit: 20, Window: time.Hour, Key: middlewares.KeyByIP},
+		middlewares.RateLimitPolicy{Name: "link-code:link", Limit: 1, Window: time.Minute, Key: middlewares.KeyByLinkToken},
+		middlewares.RateLimitPolicy{Name: "link-code:link:total", Limit: 3, Window: time.Hour, Key: middlewares.KeyByLinkToken},
+	)
+	// the email is not part of the request, wrong codes are also counted per mfa token
+	mfaLimit := middlewares.RateLimit(rds,
+		middlewares.RateLimitPolicy{Name: "mfa:ip", Limit: 30, Window: time.Minute, Key: middlewares.KeyByIP},
+	)
+	// attempts are also counted per code, so only the ip is limited here
+	// and nobody can block an address from using its own code
+	verifyCodeLimit := middlewares.RateLimit(rds,
+		middlewares.RateLimitPolicy{Name: "verify-code:ip", Limit: 30, Window: time.Hour, Key: middlewares.KeyByIP},
+	)
+	passwordLimit := middlewares.RateLimit(rds,
+		middlewares.RateLimitPolicy{Name: "password:user", Limit: 5, Window: time.Hour, Key: middlewares.KeyByUserID},
+	)
+
+	e.GET("/.well-known/jwks.json", middlewares.JWKSHandler)
 
 	// define routes/ endpoint USER
-	e.POST("/login", userHandlerAPI.Login)
+	e.POST("/login", userHandlerAPI.Login, loginLimit)
+	e.POST("/login/2fa", userHandlerAPI.LoginSecondFactor, mfaLimit)
+	e.POST("/login/magic-link", userHandlerAPI.RequestMagicLink, emailLimit)
+	e.GET("/login/magic-link/callback", userHandlerAPI.LoginMagicLink)
+	e.POST("/login/passkey/begin", userHandlerAPI.BeginPasskeyLogin, loginLimit)
+	e.POST("/login/passkey/finish", userHandlerAPI.FinishPasskeyLogin, loginLimit)
+	e.POST("/login/oauth/link", userHandlerAPI.ConfirmLink, loginLimit)
+	e.POST("/login/oauth/link/code", userHandlerAPI.RequestLinkCode, linkCodeLimit)
+	e.PATCH("/unlock-account", userHandlerAPI.UnlockAccount)
+	e.PATCH("/lock-account", userHandlerAPI.LockAccount)
+	e.POST("/token/refresh", userHandlerAPI.RefreshToken)
+	e.POST("/logout", userHandlerAPI.Logout, middlewares.JWTMiddleware(userData))
+	e.GET("/sessions", userHandlerAPI.GetSessions, middlewares.JWTMiddleware(userData))
+	e.DELETE("/sessions", userHandlerAPI.DeleteOtherSessions, middlewares.JWTMiddleware(userData))
+	e.DELETE("/sessions/:id", userHandlerAPI.DeleteSession, middlewares.JWTMiddleware(userData))
 	e.POST("/users", userHandlerAPI.RegisterUser)
-	e.GET("/users", userHandlerAPI.GetUser, middlewares.JWTMiddleware())
-	e.PUT("/users", userHandlerAPI.UpdateUser, middlewares.JWTMiddleware())
-	e.DELETE("/users", userHandlerAPI.DeleteUser, middlewares.JWTMiddleware())
-	e.PUT("/change-password", userHandlerAPI.ChangePassword, middlewares.JWTMiddleware())
-	e.POST("forgot-password", userHandlerAPI.ForgotPassword)
+	e.GET("/users", userHandlerAPI.GetUser, middlewares.JWTMiddleware(userData))
+	e.PUT("/users", userHandlerAPI.UpdateUser, middlewares.JWTMiddleware(userData))
+	e.DELETE("/users", userHandlerAPI.DeleteUser, middlewares.JWTMiddleware(userData))
+	e.POST("/change-email", userHandlerAPI.RequestEmailChange, middlewares.JWTMiddleware(userData), passwordLimit, codeLimit)
+	e.PATCH("/change-email/confirm", userHandlerAPI.ConfirmEmailChange)
+	e.POST("/change-email/confirm", userHandlerAPI.ConfirmEmailChangeCode, middlewares.JWTMiddleware(userData))
+	e.PATCH("/change-email/cancel", userHandlerAPI.CancelEmailChange)
+	e.POST("/passkeys/register/begin", userHandlerAPI.BeginPasskeyRegistration, middlewares.JWTMiddleware(userData))
+	e.POST("/passkeys/register/finish", userHandlerAPI.FinishPasskeyRegistration, middlewares.JWTMiddleware(userData))
+	e.GET("/passkeys", userHandlerAPI.GetPasskeys, middlewares.JWTMiddleware(userData))
+	e.DELETE("/passkeys/:id", userHandlerAPI.DeletePasskey, middlewares.JWTMiddleware(userData))
+	e.GET("/identities", userHandlerAPI.GetIdentities, middlewares.JWTMiddleware(userData))
+	e.POST("/identities/:provider", userHandlerAPI.LinkIdentity, middlewares.JWTMiddleware(userData))
+	e.DELETE("/identities/:id", userHandlerAPI.UnlinkIdentity, middlewares.JWTMiddleware(userData))
+	e.POST("/2fa/totp/setup", userHandlerAPI.SetupTotp, middlewares.JWTMiddleware(userData))
+	e.POST("/2fa/totp/confirm", userHandlerAPI.ConfirmTotp, middlewares.JWTMiddleware(userData))
+	e.PUT("/2fa/email", userHandlerAPI.SetEmailOtp, middlewares.JWTMiddleware(userData))
+	e.PUT("/change-password", userHandlerAPI.ChangePassword, middlewares.JWTMiddleware(userData), passwordLimit)
+	e.POST("forgot-password", userHandlerAPI.ForgotPassword, emailLimit)
 	e.PATCH("reset-password", userHandlerAPI.ResetPassword)
-	e.POST("verification", userHandlerAPI.SendVerifyEmail)
+	e.POST("verification", userHandlerAPI.SendVerifyEmail, emailLimit)
 	e.PATCH("verification", userHandlerAPI.VerifyEmailLink)
-	e.POST("request-code-password", userHandlerAPI.RequestCodePassword)
-	e.PATCH("reset-password-code", userHandlerAPI.ResetPasswordCode)
-	e.POST("request-code-verify", userHandlerAPI.RequestCodeVerify)
+	e.POST("request-code-password", userHandlerAPI.RequestCodePassword, codeLimit)
+	e.PATCH("reset-password-code", userHandlerAPI.ResetPasswordCode, verifyCodeLimit)
+	e.POST("request-code-verify", userHandlerAPI.RequestCodeVerify, codeLimit)
 	e.PATCH("verification-email", userHandlerAPI.VerifyEmailCode)
 	e.GET("/oauth-google", userHandlerAPI.GoogleLoginRedirect)
 	e.GET("/api/sessions/oauth/google", userHandlerAPI.RegisterWithGoogle)
@@ -0,0 +1,98 @@
+// Command breachfilter builds the bloom filter used to reject breached passwords.
+//
+//	go run ./cmd/breachfilter -in rockyou.txt -out breached.bloom
+//	go run ./cmd/breachfilter -in pwned-passwords-sha1.txt -sha1 -out breached.bloom
+//
+// The source has one password per line, or with -sha1 one HIBP hash list line
+// ("<sha1 hex>:<count>") per line. Point BREACHFILTER at the output file.
+package main
+
+import (
+	"bufio"
+	"emailnotifl3n/utils/breach"
+	"flag"
+	"log"
+	"os"
+)
+
+func main() {
+	in := flag.String("in", "", "source list, one password or sha1 per line")
+	out := flag.String("out", "breached.bloom", "filter file to write")
+	isSha1 := flag.Bool("sha1", false, "source lines are HIBP sha1 hashes instead of plain passwords")
+	rate := flag.Float64("fp", 0.001, "false positive rate")
+	flag.Parse()
+
+	if *in == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// first pass counts the entries to size the filter
+	count, err := countLines(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	filter := breach.NewFilter(count, *rate)
+
+	source, err := os.Open(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer source.Close()
+
+	var added, skipped uint64
+	scanner := bufio.NewScanner(source)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		if !*isSha1 {
+			filter.Add(line)
+			added++
+			continue
+		}
+
+		digest, err := breach.ParseDigest(line)
+		if err != nil {
+			skipped++
+			continue
+		}
+		filter.AddDigest(digest)
+		added++
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	target, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := filter.WriteTo(target); err != nil {
+		log.Fatal(err)
+	}
+	if err := target.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %s with %d entries, %d lines skipped", *out, added, skipped)
+}
+
+func countLines(path string) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var count uint64
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if scanner.Text() != "" {
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
@@ -2,6 +2,7 @@ package data
 
 import (
 	"emailnotifl3n/features/user"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -15,6 +16,11 @@ type User struct {
 	PhotoProfile     string
 	Verified         bool
 	RegistrationType string
+	TokenVersion     int `gorm:"not null;default:0"`
+	TotpSecret       string
+	TotpEnabled      bool
+	EmailOtpEnabled  bool
+	LockedAt         *time.Time
 }
 
 func CoreToModel(input user.Core) User {
@@ -31,19 +37,191 @@ func CoreToModel(input user.Core) User {
 func CoreToModelUpdate(input user.CoreUpdate) User {
 	return User{
 		Name:         input.Name,
-		Email:        input.Email,
 		PhotoProfile: input.PhotoProfile,
 	}
 }
 
 func (u User) ModelToCore() user.Core {
 	return user.Core{
-		ID:           u.ID,
-		Name:         u.Name,
-		Email:        u.Email,
-		Password:     u.Password,
-		PhotoProfile: u.PhotoProfile,
-		CreatedAt:    u.CreatedAt,
-		UpdatedAt:    u.UpdatedAt,
+		ID:               u.ID,
+		Name:             u.Name,
+		Email:            u.Email,
+		Password:         u.Password,
+		PhotoProfile:     u.PhotoProfile,
+		RegistrationType: u.RegistrationType,
+		Verified:         u.Verified,
+		TokenVersion:     u.TokenVersion,
+		TotpSecret:       u.TotpSecret,
+		TotpEnabled:      u.TotpEnabled,
+		EmailOtpEnabled:  u.EmailOtpEnabled,
+		LockedAt:         u.LockedAt,
+		CreatedAt:        u.CreatedAt,
+		UpdatedAt:        u.UpdatedAt,
+	}
+}
+
+// struct session gorm model
+type Session struct {
+	gorm.Model
+	UserID      uint `gorm:"not null;index"`
+	UserAgent   string
+	IPAddress   string
+	LoginMethod string `gorm:"not null"`
+	LastSeenAt  time.Time
+	RevokedAt   *time.Time
+}
+
+func SessionCoreToModel(input user.SessionCore) Session {
+	return Session{
+		UserID:      input.UserID,
+		UserAgent:   input.UserAgent,
+		IPAddress:   input.IPAddress,
+		LoginMethod: input.LoginMethod,
+		LastSeenAt:  input.LastSeenAt,
+		RevokedAt:   input.RevokedAt,
+	}
+}
+
+func (s Session) ModelToCore() user.SessionCore {
+	return user.SessionCore{
+		ID:          s.ID,
+		UserID:      s.UserID,
+		UserAgent:   s.UserAgent,
+		IPAddress:   s.IPAddress,
+		LoginMethod: s.LoginMethod,
+		LastSeenAt:  s.LastSeenAt,
+		RevokedAt:   s.RevokedAt,
+		CreatedAt:   s.CreatedAt,
+	}
+}
+
+// struct refresh token gorm model
+type RefreshToken struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	SessionID uint   `gorm:"not null;index"`
+	TokenHash string `gorm:"not null;uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+}
+
+func RefreshTokenCoreToModel(input user.RefreshTokenCore) RefreshToken {
+	return RefreshToken{
+		UserID:    input.UserID,
+		TokenHash: input.TokenHash,
+		SessionID: input.SessionID,
+		ExpiresAt: input.ExpiresAt,
+		UsedAt:    input.UsedAt,
+		RevokedAt: input.RevokedAt,
+	}
+}
+
+func (r RefreshToken) ModelToCore() user.RefreshTokenCore {
+	return user.RefreshTokenCore{
+		ID:        r.ID,
+		UserID:    r.UserID,
+		TokenHash: r.TokenHash,
+		SessionID: r.SessionID,
+		ExpiresAt: r.ExpiresAt,
+		UsedAt:    r.UsedAt,
+		RevokedAt: r.RevokedAt,
+		CreatedAt: r.CreatedAt,
+	}
+}
+
+// struct recovery code gorm model
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"not null;index"`
+	CodeHash string `gorm:"not null"`
+	UsedAt   *time.Time
+}
+
+func (r RecoveryCode) ModelToCore() user.RecoveryCodeCore {
+	return user.RecoveryCodeCore{
+		ID:       r.ID,
+		UserID:   r.UserID,
+		CodeHash: r.CodeHash,
+		UsedAt:   r.UsedAt,
+	}
+}
+
+// struct password history gorm model, holds hashes of replaced passwords
+type PasswordHistory struct {
+	ID           uint   `gorm:"primarykey"`
+	UserID       uint   `gorm:"not null;index"`
+	PasswordHash string `gorm:"not null"`
+	CreatedAt    time.Time
+}
+
+func (PasswordHistory) TableName() string {
+	return "password_history"
+}
+
+// struct user identity gorm model, an account of a login provider linked to a user.
+// Rows are deleted for good so the provider account can be linked again.
+type UserIdentity struct {
+	ID       uint   `gorm:"primarykey"`
+	UserID   uint   `gorm:"not null;index"`
+	Provider string `gorm:"not null;uniqueIndex:idx_user_identities_provider_subject"`
+	Subject  string `gorm:"not null;uniqueIndex:idx_user_identities_provider_subject"`
+	Email    string
+	LinkedAt time.Time `gorm:"not null"`
+}
+
+func IdentityCoreToModel(input user.IdentityCore) UserIdentity {
+	return UserIdentity{
+		UserID:   input.UserID,
+		Provider: input.Provider,
+		Subject:  input.Subject,
+		Email:    input.Email,
+		LinkedAt: input.LinkedAt,
+	}
+}
+
+func (i UserIdentity) ModelToCore() user.IdentityCore {
+	return user.IdentityCore{
+		ID:       i.ID,
+		UserID:   i.UserID,
+		Provider: i.Provider,
+		Subject:  i.Subject,
+		Email:    i.Email,
+		LinkedAt: i.LinkedAt,
+	}
+}
+
+// struct passkey gorm model
+type Passkey struct {
+	gorm.Model
+	UserID       uint   `gorm:"not null;index"`
+	CredentialID string `gorm:"not null;uniqueIndex"`
+	PublicKey    []byte `gorm:"not null"`
+	SignCount    uint32
+	Name         string
+	LastUsedAt   *time.Time
+}
+
+func PasskeyCoreToModel(input user.PasskeyCore) Passkey {
+	return Passkey{
+		UserID:       input.UserID,
+		CredentialID: input.CredentialID,
+		PublicKey:    input.PublicKey,
+		SignCount:    input.SignCount,
+		Name:         input.Name,
+		LastUsedAt:   input.LastUsedAt,
+	}
+}
+
+func (p Passkey) ModelToCore() user.PasskeyCore {
+	return user.PasskeyCore{
+		ID:           p.ID,
+		UserID:       p.UserID,
+		CredentialID: p.CredentialID,
+		PublicKey:    p.PublicKey,
+		SignCount:    p.SignCount,
+		Name:         p.Name,
+		LastUsedAt:   p.LastUsedAt,
+		CreatedAt:    p.CreatedAt,
 	}
 }
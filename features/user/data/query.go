@@ -2,23 +2,37 @@ package data
 
 import (
 	"context"
+	"crypto/subtle"
 	"emailnotifl3n/app/cache"
+	"emailnotifl3n/app/config"
 	"emailnotifl3n/features/user"
+	"emailnotifl3n/utils/encrypts"
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"gorm.io/gorm"
 )
 
+// codes expire after 10 minutes
+const codeExpiration = 10 * time.Minute
+
 type userQuery struct {
-	db    *gorm.DB
-	redis cache.Redis
+	db              *gorm.DB
+	redis           cache.Redis
+	codeMaxAttempts int
+	passwordHistory int
 }
 
-func New(db *gorm.DB, redis cache.Redis) user.UserDataInterface {
+func New(db *gorm.DB, redis cache.Redis, cfg *config.AppConfig) user.UserDataInterface {
 	return &userQuery{
-		db:    db,
-		redis: redis,
+		db:              db,
+		redis:           redis,
+		codeMaxAttempts: cfg.CODE_MAX_ATTEMPTS,
+		passwordHistory: cfg.PASSWORD_HISTORY,
 	}
 }
 
@@ -63,16 +77,38 @@ func (repo *userQuery) Update(userId int, input user.CoreUpdate) error {
 }
 
 // Delete implements user.UserDataInterface.
+// Users are soft deleted, so nothing cascades: login methods are removed and
+// sessions revoked here. Pending links expire on their own, they fail on the
+// missing user meanwhile.
 func (repo *userQuery) Delete(userId int) error {
-	tx := repo.db.Delete(&User{}, userId)
-	if tx.Error != nil {
-		return tx.Error
-	}
+	return repo.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Delete(&User{}, userId)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("error record not found")
+		}
 
-	if tx.RowsAffected == 0 {
-		return errors.New("error record not found")
-	}
-	return nil
+		// a provider account or passkey left behind would point at the deleted user forever
+		for _, model := range []any{&UserIdentity{}, &Passkey{}, &RecoveryCode{}, &PasswordHistory{}} {
+			err := tx.Unscoped().Where("user_id = ?", userId).Delete(model).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		err := tx.Model(&Session{}).
+			Where("user_id = ? AND revoked_at IS NULL", userId).
+			Update("revoked_at", now).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&RefreshToken{}).
+			Where("user_id = ? AND revoked_at IS NULL", userId).
+			Update("revoked_at", now).Error
+	})
 }
 
 // Login implements user.UserDataInterface.
@@ -88,48 +124,294 @@ func (repo *userQuery) Login(email string, password string) (data *user.Core, er
 }
 
 // ChangePassword implements user.UserDataInterface.
-func (repo *userQuery) ChangePassword(userId int, oldPassword, newPassword string) error {
+func (repo *userQuery) ChangePassword(userId int, newPassword string) error {
+	return repo.updatePassword(newPassword, "id = ?", userId)
+}
+
+// UpdatePasswordHash implements user.UserDataInterface.
+// The password stays the same, so issued tokens stay valid.
+func (repo *userQuery) UpdatePasswordHash(userId int, hashed string) error {
+	tx := repo.db.Model(&User{}).Where("id = ?", userId).Update("password", hashed)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	return nil
+}
+
+// ResetPassword implements user.UserDataInterface.
+func (repo *userQuery) ResetPasswordLink(userId int, newPassword string) error {
+	return repo.updatePassword(newPassword, "id = ?", userId)
+}
+
+// SelectByEmail implements user.UserDataInterface.
+func (repo *userQuery) SelectByEmail(email string) (*user.Core, error) {
 	var userGorm User
-	userGorm.Password = newPassword
-	tx := repo.db.Model(&User{}).Where("id = ?", userId).Updates(&userGorm)
+	tx := repo.db.Where(" email = ?", email).First(&userGorm)
+	if tx.Error != nil {
+		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			return nil, user.ErrEmailNotFound
+		}
+		return nil, tx.Error
+	}
+
+	result := userGorm.ModelToCore()
+	return &result, nil
+}
+
+// updatePassword sets a new password, lifts a lock set by the owner and bumps the
+// token version, so every access token issued before the change is rejected.
+// The replaced hash moves to the password history in the same transaction.
+func (repo *userQuery) updatePassword(newPassword string, query string, args ...any) error {
+	return repo.db.Transaction(func(tx *gorm.DB) error {
+		var userGorm User
+		err := tx.Select("id", "password").Where(query, args...).First(&userGorm).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return errors.New("error record not found")
+			}
+			return err
+		}
+
+		err = tx.Model(&User{}).Where("id = ?", userGorm.ID).Updates(map[string]any{
+			"password":      newPassword,
+			"locked_at":     nil,
+			"token_version": gorm.Expr("token_version + 1"),
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		// the current password is checked from the users table, so the
+		// history only needs the passwords before it
+		keep := repo.passwordHistory - 1
+		if keep > 0 && userGorm.Password != "" {
+			err = tx.Create(&PasswordHistory{UserID: userGorm.ID, PasswordHash: userGorm.Password}).Error
+			if err != nil {
+				return err
+			}
+		}
+		if keep < 0 {
+			keep = 0
+		}
+		return tx.Where("user_id = ?", userGorm.ID).
+			Where("id NOT IN (?)", tx.Model(&PasswordHistory{}).Select("id").Where("user_id = ?", userGorm.ID).Order("id DESC").Limit(keep)).
+			Delete(&PasswordHistory{}).Error
+	})
+}
+
+// LockAccount implements user.UserDataInterface.
+// Bumping the token version rejects every access token issued so far.
+func (repo *userQuery) LockAccount(userId int) error {
+	tx := repo.db.Model(&User{}).Where("id = ?", userId).Updates(map[string]any{
+		"locked_at":     time.Now(),
+		"token_version": gorm.Expr("token_version + 1"),
+	})
 	if tx.Error != nil {
 		return tx.Error
 	}
 
 	if tx.RowsAffected == 0 {
-		return errors.New("error record not found ")
+		return errors.New("error record not found")
 	}
 	return nil
 }
 
-// ResetPassword implements user.UserDataInterface.
-func (repo *userQuery) ResetPasswordLink(userId int, newPassword string) error {
-	var userGorm User
-	userGorm.Password = newPassword
+// CreateEmailChange implements user.UserDataInterface.
+// A new request replaces the pending one.
+func (repo *userQuery) CreateEmailChange(userId int, input user.EmailChangeCore, expiration time.Duration) error {
+	ctx := context.Background()
+	return repo.redis.SetWithExpiration(ctx, emailChangeKey(userId), input.Nonce+":"+input.CancelNonce+":"+input.NewEmail, expiration)
+}
 
-	tx := repo.db.Model(&User{}).Where("id = ?", userId).Updates(&userGorm)
+// SelectEmailChange implements user.UserDataInterface.
+func (repo *userQuery) SelectEmailChange(userId int) (*user.EmailChangeCore, error) {
+	ctx := context.Background()
+	val, err := repo.redis.Get(ctx, emailChangeKey(userId))
+	if err != nil {
+		if err == redis.Nil {
+			return nil, errors.New("tidak ada permintaan ganti email atau sudah kedaluwarsa")
+		}
+		return nil, err
+	}
+
+	parts := strings.SplitN(val, ":", 3)
+	if len(parts) != 3 {
+		return nil, errors.New("permintaan ganti email tidak valid")
+	}
+	return &user.EmailChangeCore{Nonce: parts[0], CancelNonce: parts[1], NewEmail: parts[2]}, nil
+}
+
+// DeleteEmailChange implements user.UserDataInterface.
+func (repo *userQuery) DeleteEmailChange(userId int) error {
+	ctx := context.Background()
+	return repo.redis.Delete(ctx, emailChangeKey(userId))
+}
+
+// ChangeEmail implements user.UserDataInterface.
+// The new address was confirmed by its owner, so it counts as verified.
+func (repo *userQuery) ChangeEmail(userId int, email string) error {
+	tx := repo.db.Model(&User{}).Where("id = ?", userId).Updates(map[string]any{
+		"email":    email,
+		"verified": true,
+	})
 	if tx.Error != nil {
 		return tx.Error
 	}
 
+	if tx.RowsAffected == 0 {
+		return errors.New("error record not found")
+	}
 	return nil
 }
 
-// SelectByEmail implements user.UserDataInterface.
-func (repo *userQuery) SelectByEmail(email string) (*user.Core, error) {
-	var userGorm User
-	tx := repo.db.Where(" email = ?", email).First(&userGorm)
+// CreateOAuthState implements user.UserDataInterface.
+func (repo *userQuery) CreateOAuthState(input user.OAuthStateCore, expiration time.Duration) error {
+	ctx := context.Background()
+	val := strings.Join([]string{input.Provider, input.Verifier, strconv.Itoa(int(input.LinkUserID)), input.RedirectURI}, "\n")
+	return repo.redis.SetWithExpiration(ctx, oauthStateKey(input.State), val, expiration)
+}
+
+// ConsumeOAuthState implements user.UserDataInterface.
+// A state is single use, it is deleted on read.
+func (repo *userQuery) ConsumeOAuthState(state string) (*user.OAuthStateCore, error) {
+	ctx := context.Background()
+	val, err := repo.redis.GetDelete(ctx, oauthStateKey(state))
+	if err != nil {
+		if err == redis.Nil {
+			return nil, errors.New("state oauth sudah digunakan atau kedaluwarsa")
+		}
+		return nil, err
+	}
+
+	parts := strings.SplitN(val, "\n", 4)
+	if len(parts) != 4 {
+		return nil, errors.New("state oauth tidak valid")
+	}
+
+	linkUserId, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return nil, errors.New("state oauth tidak valid")
+	}
+	return &user.OAuthStateCore{
+		State:       state,
+		Provider:    parts[0],
+		Verifier:    parts[1],
+		LinkUserID:  uint(linkUserId),
+		RedirectURI: parts[3],
+	}, nil
+}
+
+// CreatePendingLink implements user.UserDataInterface.
+func (repo *userQuery) CreatePendingLink(input user.PendingLinkCore, expiration time.Duration) error {
+	ctx := context.Background()
+	val := strings.Join([]string{strconv.Itoa(int(input.UserID)), input.Identity.Provider, input.Identity.Subject, input.Identity.Email}, "\n")
+	return repo.redis.SetWithExpiration(ctx, pendingLinkKey(input.Token), val, expiration)
+}
+
+// SelectPendingLink implements user.UserDataInterface.
+func (repo *userQuery) SelectPendingLink(token string) (*user.PendingLinkCore, error) {
+	ctx := context.Background()
+	val, err := repo.redis.Get(ctx, pendingLinkKey(token))
+	if err != nil {
+		if err == redis.Nil {
+			return nil, errors.New("permintaan menghubungkan akun tidak ditemukan atau kedaluwarsa")
+		}
+		return nil, err
+	}
+
+	parts := strings.SplitN(val, "\n", 4)
+	if len(parts) != 4 {
+		return nil, errors.New("permintaan menghubungkan akun tidak valid")
+	}
+
+	userId, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, errors.New("permintaan menghubungkan akun tidak valid")
+	}
+	return &user.PendingLinkCore{
+		Token:  token,
+		UserID: uint(userId),
+		Identity: user.IdentityCore{
+			Provider: parts[1],
+			Subject:  parts[2],
+			Email:    parts[3],
+		},
+	}, nil
+}
+
+// DeletePendingLink implements user.UserDataInterface.
+func (repo *userQuery) DeletePendingLink(token string) error {
+	ctx := context.Background()
+	return repo.redis.Delete(ctx, pendingLinkKey(token))
+}
+
+// InsertIdentity implements user.UserDataInterface.
+func (repo *userQuery) InsertIdentity(input user.IdentityCore) error {
+	identityGorm := IdentityCoreToModel(input)
+	tx := repo.db.Create(&identityGorm)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	return nil
+}
+
+// SelectIdentity implements user.UserDataInterface.
+func (repo *userQuery) SelectIdentity(provider, subject string) (*user.IdentityCore, error) {
+	var identityGorm UserIdentity
+	tx := repo.db.Where("provider = ? AND subject = ?", provider, subject).First(&identityGorm)
 	if tx.Error != nil {
 		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
-			return nil, errors.New("email tidak ada")
+			return nil, user.ErrIdentityNotFound
 		}
 		return nil, tx.Error
 	}
 
-	result := userGorm.ModelToCore()
+	result := identityGorm.ModelToCore()
 	return &result, nil
 }
 
+// SelectIdentitiesByUser implements user.UserDataInterface.
+func (repo *userQuery) SelectIdentitiesByUser(userId int) ([]user.IdentityCore, error) {
+	var identitiesGorm []UserIdentity
+	tx := repo.db.Where("user_id = ?", userId).Order("linked_at").Find(&identitiesGorm)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	var results []user.IdentityCore
+	for _, v := range identitiesGorm {
+		results = append(results, v.ModelToCore())
+	}
+	return results, nil
+}
+
+// DeleteIdentity implements user.UserDataInterface.
+func (repo *userQuery) DeleteIdentity(userId int, id uint) error {
+	tx := repo.db.Where("user_id = ?", userId).Delete(&UserIdentity{}, id)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if tx.RowsAffected == 0 {
+		return errors.New("error record not found")
+	}
+	return nil
+}
+
+// SelectPasswordHistory implements user.UserDataInterface.
+func (repo *userQuery) SelectPasswordHistory(userId int, limit int) ([]string, error) {
+	var hashes []string
+	if limit <= 0 {
+		return hashes, nil
+	}
+
+	tx := repo.db.Model(&PasswordHistory{}).Where("user_id = ?", userId).Order("id DESC").Limit(limit).Pluck("password_hash", &hashes)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return hashes, nil
+}
+
 // VerifyEmailLink implements user.UserDataInterface.
 func (repo *userQuery) VerifyEmailLink(userId int, verification bool) error {
 	var userGorm User
@@ -143,76 +425,649 @@ func (repo *userQuery) VerifyEmailLink(userId int, verification bool) error {
 	return nil
 }
 
-// RequestCode implements user.UserDataInterface.
-func (repo *userQuery) CreateCode(email, code string) error {
-	ctx := context.Background()
-	err := repo.redis.Set(ctx, email, code)
-	return err
+// CreateCode implements user.UserDataInterface.
+func (repo *userQuery) CreateCode(purpose, email, code string) error {
+	return repo.createCode(codeKey(purpose, email), code)
 }
 
 // DeleteCode implements user.UserDataInterface.
-func (repo *userQuery) DeleteCode(email string) error {
-	ctx := context.Background()
+func (repo *userQuery) DeleteCode(purpose, email string) error {
+	return repo.burnCode(codeKey(purpose, email))
+}
 
-	err := repo.redis.Delete(ctx, email)
+// VerifyCode implements user.UserDataInterface.
+// Codes are single use, a correct code is deleted.
+func (repo *userQuery) VerifyCode(purpose, email, code string) error {
+	key := codeKey(purpose, email)
+	err := repo.verifyCode(key, code)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	return repo.burnCode(key)
 }
 
 // CheckCode implements user.UserDataInterface.
-func (repo *userQuery) CheckCode(email string) (bool, error) {
+// Counts as an attempt like VerifyCode but leaves a correct code in place,
+// ConsumeCode uses it up once the rest of the request is accepted.
+func (repo *userQuery) CheckCode(purpose, email, code string) error {
+	return repo.verifyCode(codeKey(purpose, email), code)
+}
+
+// ConsumeCode implements user.UserDataInterface.
+func (repo *userQuery) ConsumeCode(purpose, email, code string) error {
 	ctx := context.Background()
-	_, err := repo.redis.Get(ctx, email)
+	key := codeKey(purpose, email)
+	// taken atomically so a code checked by two requests is only used once
+	storedHash, err := repo.redis.GetDelete(ctx, key)
 	if err != nil {
 		if err == redis.Nil {
-			return false, nil
+			return errors.New("kode tidak ditemukan")
 		}
-		return false, err
+		return err
 	}
-	return true, nil
+	if subtle.ConstantTimeCompare([]byte(storedHash), []byte(codeHash(key, code))) != 1 {
+		return errors.New("kode tidak ditemukan")
+	}
+	return repo.redis.Delete(ctx, codeAttemptsKey(key))
 }
 
-// VerifyEmailCode implements user.UserDataInterface.
-func (repo *userQuery) VerifyCode(email string, code string) error {
+// codes are stored hashed together with their key. A new code keeps the wrong
+// guesses made on the one it replaces, asking again doesn't give more attempts,
+// they only start over once a code is used or burned.
+func (repo *userQuery) createCode(key, code string) error {
 	ctx := context.Background()
-	storedCode, err := repo.redis.Get(ctx, email)
+	return repo.redis.SetWithExpiration(ctx, key, codeHash(key, code), codeExpiration)
+}
+
+func (repo *userQuery) verifyCode(key, code string) error {
+	ctx := context.Background()
+	storedHash, err := repo.redis.Get(ctx, key)
 	if err != nil {
 		if err == redis.Nil {
 			return errors.New("kode tidak ditemukan")
 		}
 		return err
 	}
-	if storedCode != code {
-		return errors.New("kode anda salah")
+
+	// counted before comparing so parallel guesses can't exceed the limit
+	attempts, err := repo.redis.Increment(ctx, codeAttemptsKey(key), codeExpiration)
+	if err != nil {
+		return err
+	}
+	if int(attempts) > repo.codeMaxAttempts {
+		if err := repo.burnCode(key); err != nil {
+			return err
+		}
+		return errors.New("terlalu banyak percobaan, silakan minta kode baru")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(storedHash), []byte(codeHash(key, code))) != 1 {
+		if int(attempts) == repo.codeMaxAttempts {
+			if err := repo.burnCode(key); err != nil {
+				return err
+			}
+			return errors.New("kode anda salah, silakan minta kode baru")
+		}
+		return fmt.Errorf("kode anda salah, sisa %d percobaan", repo.codeMaxAttempts-int(attempts))
 	}
 
 	return nil
 }
 
+func (repo *userQuery) burnCode(key string) error {
+	ctx := context.Background()
+	err := repo.redis.Delete(ctx, key)
+	if err != nil {
+		return err
+	}
+	return repo.redis.Delete(ctx, codeAttemptsKey(key))
+}
+
+func codeHash(key, code string) string {
+	return encrypts.HashToken(key + ":" + code)
+}
+
+func codeAttemptsKey(key string) string {
+	return "code_attempts:" + key
+}
+
 // ResetPasswordCode implements user.UserDataInterface.
 func (repo userQuery) ResetPasswordCode(email, newPassword string) error {
+	return repo.updatePassword(newPassword, "email = ?", email)
+}
+
+// VerifyEmailCode implements user.UserDataInterface.
+func (repo *userQuery) VerifyEmailCode(email string, verification bool) error {
 	var userGorm User
-	userGorm.Password = newPassword
+	userGorm.Verified = verification
 
 	tx := repo.db.Model(&User{}).Where("email = ?", email).Updates(&userGorm)
 	if tx.Error != nil {
 		return tx.Error
 	}
+
 	return nil
 }
 
-// VerifyEmailCode implements user.UserDataInterface.
-func (repo *userQuery) VerifyEmailCode(email string, verification bool) error {
+// InsertRefreshToken implements user.UserDataInterface.
+func (repo *userQuery) InsertRefreshToken(input user.RefreshTokenCore) error {
+	dataGorm := RefreshTokenCoreToModel(input)
+
+	tx := repo.db.Create(&dataGorm)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return errors.New("insert failed, row affected = 0")
+	}
+	return nil
+}
+
+// SelectRefreshToken implements user.UserDataInterface.
+func (repo *userQuery) SelectRefreshToken(tokenHash string) (*user.RefreshTokenCore, error) {
+	var tokenGorm RefreshToken
+	tx := repo.db.Where("token_hash = ?", tokenHash).First(&tokenGorm)
+	if tx.Error != nil {
+		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			return nil, errors.New("refresh token tidak valid")
+		}
+		return nil, tx.Error
+	}
+
+	result := tokenGorm.ModelToCore()
+	return &result, nil
+}
+
+// UseRefreshToken implements user.UserDataInterface.
+func (repo *userQuery) UseRefreshToken(id uint) error {
+	tx := repo.db.Model(&RefreshToken{}).
+		Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", id).
+		Update("used_at", time.Now())
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if tx.RowsAffected == 0 {
+		return errors.New("refresh token sudah digunakan")
+	}
+	return nil
+}
+
+// InsertSession implements user.UserDataInterface.
+func (repo *userQuery) InsertSession(input user.SessionCore) (uint, error) {
+	dataGorm := SessionCoreToModel(input)
+
+	tx := repo.db.Create(&dataGorm)
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return 0, errors.New("insert failed, row affected = 0")
+	}
+	return dataGorm.ID, nil
+}
+
+// SelectSessionById implements user.UserDataInterface.
+func (repo *userQuery) SelectSessionById(sessionId uint) (*user.SessionCore, error) {
+	var sessionGorm Session
+	tx := repo.db.Where("revoked_at IS NULL").First(&sessionGorm, sessionId)
+	if tx.Error != nil {
+		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			return nil, errors.New("session tidak ditemukan")
+		}
+		return nil, tx.Error
+	}
+
+	result := sessionGorm.ModelToCore()
+	return &result, nil
+}
+
+// SelectSessionsByUser implements user.UserDataInterface.
+func (repo *userQuery) SelectSessionsByUser(userId int) ([]user.SessionCore, error) {
+	var sessionsGorm []Session
+	tx := repo.db.Where("user_id = ? AND revoked_at IS NULL", userId).Order("last_seen_at desc").Find(&sessionsGorm)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	var results []user.SessionCore
+	for _, v := range sessionsGorm {
+		results = append(results, v.ModelToCore())
+	}
+	return results, nil
+}
+
+// TouchSession implements user.UserDataInterface.
+func (repo *userQuery) TouchSession(sessionId uint) error {
+	tx := repo.db.Model(&Session{}).Where("id = ?", sessionId).Update("last_seen_at", time.Now())
+	if tx.Error != nil {
+		return tx.Error
+	}
+	return nil
+}
+
+// IsSessionActive implements user.UserDataInterface.
+func (repo *userQuery) IsSessionActive(sessionId uint) (bool, error) {
+	var count int64
+	tx := repo.db.Model(&Session{}).Where("id = ? AND revoked_at IS NULL", sessionId).Count(&count)
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+	return count > 0, nil
+}
+
+// RevokeSession implements user.UserDataInterface.
+func (repo *userQuery) RevokeSession(sessionId uint) error {
+	return repo.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Model(&Session{}).Where("id = ? AND revoked_at IS NULL", sessionId).Update("revoked_at", now).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&RefreshToken{}).Where("session_id = ? AND revoked_at IS NULL", sessionId).Update("revoked_at", now).Error
+	})
+}
+
+// RevokeOtherSessions implements user.UserDataInterface.
+func (repo *userQuery) RevokeOtherSessions(userId int, exceptSessionId uint) error {
+	return repo.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Model(&Session{}).
+			Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userId, exceptSessionId).
+			Update("revoked_at", now).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&RefreshToken{}).
+			Where("user_id = ? AND session_id <> ? AND revoked_at IS NULL", userId, exceptSessionId).
+			Update("revoked_at", now).Error
+	})
+}
+
+// RevokeToken implements user.UserDataInterface.
+func (repo *userQuery) RevokeToken(jti string, expiration time.Duration) error {
+	ctx := context.Background()
+	err := repo.redis.SetWithExpiration(ctx, revokedTokenKey(jti), "1", expiration)
+	return err
+}
+
+// IsTokenRevoked implements user.UserDataInterface.
+func (repo *userQuery) IsTokenRevoked(jti string) (bool, error) {
+	ctx := context.Background()
+	_, err := repo.redis.Get(ctx, revokedTokenKey(jti))
+	if err != nil {
+		if err == redis.Nil {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// SelectTokenVersion implements user.UserDataInterface.
+func (repo *userQuery) SelectTokenVersion(userId int) (int, error) {
 	var userGorm User
-	userGorm.Verified = verification
+	tx := repo.db.Select("token_version").First(&userGorm, userId)
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	return userGorm.TokenVersion, nil
+}
 
-	tx := repo.db.Model(&User{}).Where("email = ?", email).Updates(&userGorm)
+// CreateActionNonce implements user.UserDataInterface.
+func (repo *userQuery) CreateActionNonce(purpose, nonce string, userId int, expiration time.Duration) error {
+	ctx := context.Background()
+	err := repo.redis.SetWithExpiration(ctx, actionNonceKey(purpose, nonce), strconv.Itoa(userId), expiration)
+	return err
+}
+
+// ConsumeActionNonce implements user.UserDataInterface.
+func (repo *userQuery) ConsumeActionNonce(purpose, nonce string) (int, error) {
+	ctx := context.Background()
+	val, err := repo.redis.GetDelete(ctx, actionNonceKey(purpose, nonce))
+	if err != nil {
+		if err == redis.Nil {
+			return 0, errors.New("token sudah digunakan atau kedaluwarsa")
+		}
+		return 0, err
+	}
+	err = repo.redis.Delete(ctx, actionAttemptsKey(purpose, nonce))
+	if err != nil {
+		return 0, err
+	}
+
+	userId, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, err
+	}
+	return userId, nil
+}
+
+// CountActionNonceAttempt implements user.UserDataInterface.
+// Returns the attempts made with the nonce so far, this one included,
+// a nonce out of attempts is deleted.
+func (repo *userQuery) CountActionNonceAttempt(purpose, nonce string, expiration time.Duration) (int, error) {
+	ctx := context.Background()
+	key := actionNonceKey(purpose, nonce)
+	_, err := repo.redis.Get(ctx, key)
+	if err != nil {
+		if err == redis.Nil {
+			return 0, errors.New("token sudah digunakan atau kedaluwarsa")
+		}
+		return 0, err
+	}
+
+	// counted before the caller compares so parallel guesses can't exceed the limit
+	attempts, err := repo.redis.Increment(ctx, actionAttemptsKey(purpose, nonce), expiration)
+	if err != nil {
+		return 0, err
+	}
+	if int(attempts) > repo.codeMaxAttempts {
+		if err := repo.burnActionNonce(purpose, nonce); err != nil {
+			return 0, err
+		}
+		return 0, errors.New("terlalu banyak percobaan, silakan login ulang")
+	}
+	return int(attempts), nil
+}
+
+// BurnActionNonce implements user.UserDataInterface.
+func (repo *userQuery) BurnActionNonce(purpose, nonce string) error {
+	return repo.burnActionNonce(purpose, nonce)
+}
+
+func (repo *userQuery) burnActionNonce(purpose, nonce string) error {
+	ctx := context.Background()
+	err := repo.redis.Delete(ctx, actionNonceKey(purpose, nonce))
+	if err != nil {
+		return err
+	}
+	return repo.redis.Delete(ctx, actionAttemptsKey(purpose, nonce))
+}
+
+// CreateMfaLoginMethod implements user.UserDataInterface.
+// Keeps the first factor of a pending login next to its mfa nonce.
+func (repo *userQuery) CreateMfaLoginMethod(nonce, loginMethod string, expiration time.Duration) error {
+	ctx := context.Background()
+	return repo.redis.SetWithExpiration(ctx, mfaLoginMethodKey(nonce), loginMethod, expiration)
+}
+
+// ConsumeMfaLoginMethod implements user.UserDataInterface.
+func (repo *userQuery) ConsumeMfaLoginMethod(nonce string) (string, error) {
+	ctx := context.Background()
+	val, err := repo.redis.GetDelete(ctx, mfaLoginMethodKey(nonce))
+	if err != nil {
+		if err == redis.Nil {
+			return "", errors.New("token sudah digunakan atau kedaluwarsa")
+		}
+		return "", err
+	}
+	return val, nil
+}
+
+// SelectActionNonce implements user.UserDataInterface.
+func (repo *userQuery) SelectActionNonce(purpose, nonce string) (int, error) {
+	ctx := context.Background()
+	val, err := repo.redis.Get(ctx, actionNonceKey(purpose, nonce))
+	if err != nil {
+		if err == redis.Nil {
+			return 0, errors.New("token sudah digunakan atau kedaluwarsa")
+		}
+		return 0, err
+	}
+
+	userId, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, err
+	}
+	return userId, nil
+}
+
+// UpdateTotp implements user.UserDataInterface.
+func (repo *userQuery) UpdateTotp(userId int, secret string, enabled bool) error {
+	tx := repo.db.Model(&User{}).Where("id = ?", userId).Updates(map[string]any{
+		"totp_secret":  secret,
+		"totp_enabled": enabled,
+	})
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if tx.RowsAffected == 0 {
+		return errors.New("error record not found ")
+	}
+	return nil
+}
+
+// MarkTotpStepUsed implements user.UserDataInterface.
+func (repo *userQuery) MarkTotpStepUsed(userId int, step int64) (bool, error) {
+	ctx := context.Background()
+	key := fmt.Sprintf("totp_used:%d:%d", userId, step)
+	return repo.redis.SetIfNotExists(ctx, key, "1", 2*time.Minute)
+}
+
+// ReplaceRecoveryCodes implements user.UserDataInterface.
+func (repo *userQuery) ReplaceRecoveryCodes(userId int, codeHashes []string) error {
+	return repo.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Where("user_id = ?", userId).Delete(&RecoveryCode{}).Error
+		if err != nil {
+			return err
+		}
+
+		var codesGorm []RecoveryCode
+		for _, hash := range codeHashes {
+			codesGorm = append(codesGorm, RecoveryCode{UserID: uint(userId), CodeHash: hash})
+		}
+		return tx.Create(&codesGorm).Error
+	})
+}
+
+// SelectRecoveryCodes implements user.UserDataInterface.
+func (repo *userQuery) SelectRecoveryCodes(userId int) ([]user.RecoveryCodeCore, error) {
+	var codesGorm []RecoveryCode
+	tx := repo.db.Where("user_id = ? AND used_at IS NULL", userId).Find(&codesGorm)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	var results []user.RecoveryCodeCore
+	for _, v := range codesGorm {
+		results = append(results, v.ModelToCore())
+	}
+	return results, nil
+}
+
+// UseRecoveryCode implements user.UserDataInterface.
+func (repo *userQuery) UseRecoveryCode(id uint) error {
+	tx := repo.db.Model(&RecoveryCode{}).Where("id = ? AND used_at IS NULL", id).Update("used_at", time.Now())
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if tx.RowsAffected == 0 {
+		return errors.New("kode pemulihan sudah digunakan")
+	}
+	return nil
+}
+
+// UpdateEmailOtp implements user.UserDataInterface.
+func (repo *userQuery) UpdateEmailOtp(userId int, enabled bool) error {
+	tx := repo.db.Model(&User{}).Where("id = ?", userId).Update("email_otp_enabled", enabled)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if tx.RowsAffected == 0 {
+		return errors.New("error record not found ")
+	}
+	return nil
+}
+
+// CreateWebauthnChallenge implements user.UserDataInterface.
+func (repo *userQuery) CreateWebauthnChallenge(challengeId, challenge string, expiration time.Duration) error {
+	ctx := context.Background()
+	err := repo.redis.SetWithExpiration(ctx, "webauthn_challenge:"+challengeId, challenge, expiration)
+	return err
+}
+
+// ConsumeWebauthnChallenge implements user.UserDataInterface.
+func (repo *userQuery) ConsumeWebauthnChallenge(challengeId string) (string, error) {
+	ctx := context.Background()
+	challenge, err := repo.redis.GetDelete(ctx, "webauthn_challenge:"+challengeId)
+	if err != nil {
+		if err == redis.Nil {
+			return "", errors.New("challenge tidak ditemukan atau kedaluwarsa")
+		}
+		return "", err
+	}
+	return challenge, nil
+}
+
+// InsertPasskey implements user.UserDataInterface.
+func (repo *userQuery) InsertPasskey(input user.PasskeyCore) error {
+	dataGorm := PasskeyCoreToModel(input)
+
+	tx := repo.db.Omit("User").Create(&dataGorm)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return errors.New("insert failed, row affected = 0")
+	}
+	return nil
+}
+
+// SelectPasskeysByUser implements user.UserDataInterface.
+func (repo *userQuery) SelectPasskeysByUser(userId int) ([]user.PasskeyCore, error) {
+	var passkeysGorm []Passkey
+	tx := repo.db.Where("user_id = ?", userId).Order("created_at").Find(&passkeysGorm)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	var results []user.PasskeyCore
+	for _, v := range passkeysGorm {
+		results = append(results, v.ModelToCore())
+	}
+	return results, nil
+}
+
+// SelectPasskeyByCredentialId implements user.UserDataInterface.
+func (repo *userQuery) SelectPasskeyByCredentialId(credentialId string) (*user.PasskeyCore, error) {
+	var passkeyGorm Passkey
+	tx := repo.db.Where("credential_id = ?", credentialId).First(&passkeyGorm)
+	if tx.Error != nil {
+		if errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			return nil, errors.New("passkey tidak terdaftar")
+		}
+		return nil, tx.Error
+	}
+
+	result := passkeyGorm.ModelToCore()
+	return &result, nil
+}
+
+// UpdatePasskeyUsage implements user.UserDataInterface.
+func (repo *userQuery) UpdatePasskeyUsage(id uint, signCount uint32) error {
+	tx := repo.db.Model(&Passkey{}).Where("id = ?", id).Updates(map[string]any{
+		"sign_count":   signCount,
+		"last_used_at": time.Now(),
+	})
 	if tx.Error != nil {
 		return tx.Error
 	}
+	return nil
+}
 
+// DeletePasskey implements user.UserDataInterface.
+func (repo *userQuery) DeletePasskey(userId int, id uint) error {
+	tx := repo.db.Where("user_id = ?", userId).Delete(&Passkey{}, id)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if tx.RowsAffected == 0 {
+		return errors.New("error record not found")
+	}
 	return nil
 }
+
+// IncrementLoginFailures implements user.UserDataInterface.
+func (repo *userQuery) IncrementLoginFailures(key string, window time.Duration) (int, error) {
+	ctx := context.Background()
+	count, err := repo.redis.Increment(ctx, "login_failures:"+key, window)
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// ResetLoginFailures implements user.UserDataInterface.
+func (repo *userQuery) ResetLoginFailures(key string) error {
+	ctx := context.Background()
+	err := repo.redis.Delete(ctx, "login_failures:"+key)
+	if err != nil {
+		return err
+	}
+	return repo.redis.Delete(ctx, "login_block:"+key)
+}
+
+// BlockLogin implements user.UserDataInterface.
+func (repo *userQuery) BlockLogin(key string, until time.Time) error {
+	ctx := context.Background()
+	err := repo.redis.SetWithExpiration(ctx, "login_block:"+key, strconv.FormatInt(until.Unix(), 10), time.Until(until))
+	return err
+}
+
+// SelectLoginBlock implements user.UserDataInterface.
+// A zero time means logins are not blocked.
+func (repo *userQuery) SelectLoginBlock(key string) (time.Time, error) {
+	ctx := context.Background()
+	val, err := repo.redis.Get(ctx, "login_block:"+key)
+	if err != nil {
+		if err == redis.Nil {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+
+	until, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(until, 0), nil
+}
+
+// every purpose has its own namespace so a code can't be used for another flow
+func codeKey(purpose, email string) string {
+	return "code:" + purpose + ":" + strings.ToLower(email)
+}
+
+func actionNonceKey(purpose, nonce string) string {
+	return "action_token:" + purpose + ":" + nonce
+}
+
+func actionAttemptsKey(purpose, nonce string) string {
+	return "action_token_attempts:" + purpose + ":" + nonce
+}
+
+func mfaLoginMethodKey(nonce string) string {
+	return "mfa_login_method:" + nonce
+}
+
+// link tokens are only stored hashed
+func pendingLinkKey(token string) string {
+	return "pending_link:" + encrypts.HashToken(token)
+}
+
+func oauthStateKey(state string) string {
+	return "oauth_state:" + state
+}
+
+func emailChangeKey(userId int) string {
+	return "email_change:" + strconv.Itoa(userId)
+}
+
+func revokedTokenKey(jti string) string {
+	return "revoked_token:" + jti
+}
@@ -1,28 +1,211 @@
 package user
 
 import (
+	"errors"
 	"time"
 )
 
+// ErrEmailNotFound is returned when no account is registered with an email
+var ErrEmailNotFound = errors.New("email tidak ada")
+
+// ErrIdentityNotFound is returned when no account is linked to a provider identity
+var ErrIdentityNotFound = errors.New("identitas tidak ditemukan")
+
+// ErrAccountLocked is returned on sign in to an account its owner locked, a password reset unlocks it
+var ErrAccountLocked = errors.New("akun dikunci, atur ulang password untuk membukanya")
+
+// ErrProviderEmailUnverified is returned when a provider account without a verified email
+// would create a new account, the email has to be proven by registering with it first
+var ErrProviderEmailUnverified = errors.New("email akun provider belum terverifikasi, daftar dengan email lalu hubungkan akun provider dari pengaturan")
+
+// LoginBlockedError is returned while failed logins keep an account or ip blocked
+type LoginBlockedError struct {
+	RetryAt time.Time
+}
+
+func (e *LoginBlockedError) Error() string {
+	return "terlalu banyak percobaan login gagal, coba lagi setelah " + e.RetryAt.Format(time.RFC3339)
+}
+
+// LinkRequiredError is returned when a provider account signs in with the email of an
+// existing user, who has to prove ownership with ConfirmLink before it is linked
+type LinkRequiredError struct {
+	LinkToken   string
+	Provider    string
+	Email       string
+	HasPassword bool
+}
+
+func (e *LinkRequiredError) Error() string {
+	return "email sudah terdaftar, buktikan kepemilikan akun untuk menghubungkan " + e.Provider
+}
+
+// second factors offered after a successful password check
+const (
+	MfaMethodTotp  = "totp"
+	MfaMethodEmail = "email"
+)
+
+// purposes of 6-digit codes, a code only verifies for the purpose it was created for
+const (
+	CodePurposeResetPassword = "reset_password"
+	CodePurposeVerifyEmail   = "verify_email"
+	CodePurposeChangeEmail   = "change_email"
+	CodePurposeLogin         = "login"
+	CodePurposeLinkIdentity  = "link_identity"
+)
+
+const (
+	LoginMethodEmail     = "email"
+	LoginMethodMagicLink = "magic_link"
+	LoginMethodPasskey   = "passkey"
+	LoginMethodGoogle    = "google"
+	LoginMethodFacebook  = "facebook"
+)
+
 type Core struct {
-	ID           uint
-	Name         string `validate:"required"`
-	Email        string `validate:"required,email"`
-	Password     string `validate:"required"`
-	PhotoProfile string
-	Verified     bool
+	ID               uint
+	Name             string `validate:"required"`
+	Email            string `validate:"required,email"`
+	Password         string `validate:"required"`
+	PhotoProfile     string
+	Verified         bool
 	RegistrationType string
-	Code string
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
+	Code             string
+	TokenVersion     int
+	TotpSecret       string
+	TotpEnabled      bool
+	EmailOtpEnabled  bool
+	LockedAt         *time.Time
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
 }
 
+// email changes go through RequestEmailChange, CoreUpdate leaves the email alone
 type CoreUpdate struct {
 	Name         string `validate:"required"`
-	Email        string `validate:"required,email"`
 	PhotoProfile string
 }
 
+// EmailChangeCore is a pending email change. Only NewEmail and Nonce are stored,
+// Nonce binds the confirmation link to the latest request.
+// The tokens and the code are only set on the request that creates it.
+type EmailChangeCore struct {
+	NewEmail     string
+	Nonce        string
+	ConfirmToken string
+	Code         string
+	CancelNonce  string
+	CancelToken  string
+}
+
+type SessionCore struct {
+	ID          uint
+	UserID      uint
+	UserAgent   string
+	IPAddress   string
+	LoginMethod string
+	LastSeenAt  time.Time
+	RevokedAt   *time.Time
+	CreatedAt   time.Time
+}
+
+// RefreshTokenCore rotates within a session, the session acts as the token family
+type RefreshTokenCore struct {
+	ID        uint
+	UserID    uint
+	SessionID uint
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+type RecoveryCodeCore struct {
+	ID       uint
+	UserID   uint
+	CodeHash string
+	UsedAt   *time.Time
+}
+
+type PasskeyCore struct {
+	ID           uint
+	UserID       uint
+	CredentialID string
+	PublicKey    []byte
+	SignCount    uint32
+	Name         string
+	LastUsedAt   *time.Time
+	CreatedAt    time.Time
+}
+
+// options handed to navigator.credentials.create() and .get()
+type PasskeyOptionsCore struct {
+	ChallengeID     string
+	Challenge       string
+	RPID            string
+	RPName          string
+	UserHandle      string
+	UserName        string
+	UserDisplayName string
+	CredentialIDs   []string
+	Algorithms      []int
+	Timeout         time.Duration
+}
+
+// credential returned by the browser at the end of a passkey ceremony
+type PasskeyCredentialCore struct {
+	ChallengeID       string
+	Name              string
+	CredentialID      string
+	ClientDataJSON    []byte
+	AttestationObject []byte
+	AuthenticatorData []byte
+	Signature         []byte
+	UserHandle        []byte
+}
+
+// OAuthStateCore is kept server side between an oauth redirect and its callback.
+// LinkUserID is set when a signed in user links the provider instead of signing in.
+type OAuthStateCore struct {
+	State       string
+	Provider    string
+	Verifier    string
+	RedirectURI string
+	LinkUserID  uint
+}
+
+// IdentityCore links an account of a login provider to a user. Subject is the
+// stable id the provider gives the account, Email is its email when it was linked.
+// EmailVerified is reported by the provider on sign in and not stored.
+type IdentityCore struct {
+	ID            uint
+	UserID        uint
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	LinkedAt      time.Time
+}
+
+// PendingLinkCore is a provider account waiting for the owner of UserID to prove ownership
+type PendingLinkCore struct {
+	Token    string
+	UserID   uint
+	Identity IdentityCore
+}
+
+// token pair returned to the client after a successful login.
+// When a second factor is required only MfaToken is set.
+type TokenCore struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int64
+	MfaToken     string
+	MfaMethod    string
+}
+
 // interface untuk Data Layer
 type UserDataInterface interface {
 	Insert(input Core) error
@@ -30,16 +213,70 @@ type UserDataInterface interface {
 	Update(userId int, input CoreUpdate) error
 	Delete(userId int) error
 	Login(email, password string) (data *Core, err error)
-	ChangePassword(userId int, oldPassword, newPassword string) error
+	ChangePassword(userId int, newPassword string) error
+	UpdatePasswordHash(userId int, hashed string) error
+	SelectPasswordHistory(userId int, limit int) ([]string, error)
+	LockAccount(userId int) error
+	CreateEmailChange(userId int, input EmailChangeCore, expiration time.Duration) error
+	SelectEmailChange(userId int) (*EmailChangeCore, error)
+	DeleteEmailChange(userId int) error
+	ChangeEmail(userId int, email string) error
+	CreateOAuthState(input OAuthStateCore, expiration time.Duration) error
+	ConsumeOAuthState(state string) (*OAuthStateCore, error)
+	InsertIdentity(input IdentityCore) error
+	SelectIdentity(provider, subject string) (*IdentityCore, error)
+	SelectIdentitiesByUser(userId int) ([]IdentityCore, error)
+	DeleteIdentity(userId int, id uint) error
+	CreatePendingLink(input PendingLinkCore, expiration time.Duration) error
+	SelectPendingLink(token string) (*PendingLinkCore, error)
+	DeletePendingLink(token string) error
 	SelectByEmail(email string) (*Core, error)
 	ResetPasswordLink(userId int, newPassword string) error
 	VerifyEmailLink(userId int, verification bool) error
-	CreateCode(email, code string) error
-	CheckCode(email string) (bool, error)
-	DeleteCode(email string)error
-	VerifyCode(email, code string) error
+	CreateCode(purpose, email, code string) error
+	DeleteCode(purpose, email string) error
+	VerifyCode(purpose, email, code string) error
+	CheckCode(purpose, email, code string) error
+	ConsumeCode(purpose, email, code string) error
 	VerifyEmailCode(email string, verification bool) error
 	ResetPasswordCode(email, newPassword string) error
+	InsertRefreshToken(input RefreshTokenCore) error
+	SelectRefreshToken(tokenHash string) (*RefreshTokenCore, error)
+	UseRefreshToken(id uint) error
+	InsertSession(input SessionCore) (uint, error)
+	SelectSessionById(sessionId uint) (*SessionCore, error)
+	SelectSessionsByUser(userId int) ([]SessionCore, error)
+	TouchSession(sessionId uint) error
+	IsSessionActive(sessionId uint) (bool, error)
+	RevokeSession(sessionId uint) error
+	RevokeOtherSessions(userId int, exceptSessionId uint) error
+	RevokeToken(jti string, expiration time.Duration) error
+	IsTokenRevoked(jti string) (bool, error)
+	SelectTokenVersion(userId int) (int, error)
+	CreateActionNonce(purpose, nonce string, userId int, expiration time.Duration) error
+	ConsumeActionNonce(purpose, nonce string) (int, error)
+	SelectActionNonce(purpose, nonce string) (int, error)
+	CountActionNonceAttempt(purpose, nonce string, expiration time.Duration) (int, error)
+	BurnActionNonce(purpose, nonce string) error
+	CreateMfaLoginMethod(nonce, loginMethod string, expiration time.Duration) error
+	ConsumeMfaLoginMethod(nonce string) (string, error)
+	UpdateTotp(userId int, secret string, enabled bool) error
+	MarkTotpStepUsed(userId int, step int64) (bool, error)
+	ReplaceRecoveryCodes(userId int, codeHashes []string) error
+	SelectRecoveryCodes(userId int) ([]RecoveryCodeCore, error)
+	UseRecoveryCode(id uint) error
+	UpdateEmailOtp(userId int, enabled bool) error
+	CreateWebauthnChallenge(challengeId, challenge string, expiration time.Duration) error
+	ConsumeWebauthnChallenge(challengeId string) (string, error)
+	InsertPasskey(input PasskeyCore) error
+	SelectPasskeysByUser(userId int) ([]PasskeyCore, error)
+	SelectPasskeyByCredentialId(credentialId string) (*PasskeyCore, error)
+	UpdatePasskeyUsage(id uint, signCount uint32) error
+	DeletePasskey(userId int, id uint) error
+	IncrementLoginFailures(key string, window time.Duration) (int, error)
+	ResetLoginFailures(key string) error
+	BlockLogin(key string, until time.Time) error
+	SelectLoginBlock(key string) (time.Time, error)
 }
 
 // interface untuk Service Layer
@@ -48,14 +285,45 @@ type UserServiceInterface interface {
 	GetById(userId int) (*Core, error)
 	Update(userId int, input CoreUpdate) error
 	Delete(userId int) error
-	Login(email, password string) (data *Core, token string, err error)
-	ChangePassword(userId int, oldPassword, newPassword string) error
+	Login(email, password string, session SessionCore) (data *Core, token *TokenCore, err error)
+	ChangePassword(userId int, sessionId uint, oldPassword, newPassword string) error
 	ForgotPassword(email string) (data *Core, token string, err error)
-	ResetPassword(userId int, newPassword string) error
-	VerifyEmailLink(userId int) error
+	ResetPassword(token, newPassword string) error
+	RequestVerifyEmail(email string) (data *Core, token string, err error)
+	VerifyEmailLink(token string) error
 	SelectByEmail(email string) (*Core, error)
-	RequestCode(email, code string) (data *Core, err error)
+	RequestCode(purpose, email string) (data *Core, code string, err error)
 	VerifyEmailCode(email string, code string) error
 	ResetPasswordCode(email, newPassword, code string) error
-	RegisterGoogle(input Core) error
-}
\ No newline at end of file
+	LoginWithProvider(input Core, identity IdentityCore, session SessionCore) (data *Core, token *TokenCore, err error)
+	RefreshToken(refreshToken string) (*TokenCore, error)
+	Logout(userId int, sessionId uint, jti string, expiresAt time.Time) error
+	GetSessions(userId int) ([]SessionCore, error)
+	EndSession(userId int, sessionId uint) error
+	EndOtherSessions(userId int, currentSessionId uint) error
+	SetupTotp(userId int) (secret string, uri string, err error)
+	ConfirmTotp(userId int, code string) (recoveryCodes []string, err error)
+	LoginSecondFactor(mfaToken, code string, session SessionCore) (data *Core, token *TokenCore, err error)
+	SetEmailOtp(userId int, enabled bool) error
+	RequestMagicLink(email string) (data *Core, token string, err error)
+	LoginMagicLink(token string, session SessionCore) (data *Core, result *TokenCore, err error)
+	UnlockAccount(token string) error
+	LockAccount(token string) error
+	RequestEmailChange(userId int, newEmail, password string) (data *Core, change *EmailChangeCore, err error)
+	ConfirmEmailChange(token string) error
+	ConfirmEmailChangeCode(userId int, sessionId uint, code string) error
+	CancelEmailChange(token string) error
+	BeginOAuth(provider, redirectURI string, linkUserId int) (*OAuthStateCore, error)
+	FinishOAuth(provider, state string) (*OAuthStateCore, error)
+	GetIdentities(userId int) ([]IdentityCore, error)
+	LinkIdentity(userId int, identity IdentityCore) error
+	UnlinkIdentity(userId int, identityId uint) error
+	RequestLinkCode(linkToken string) (data *Core, code string, err error)
+	ConfirmLink(linkToken, password, code string, session SessionCore) (data *Core, token *TokenCore, err error)
+	BeginPasskeyRegistration(userId int) (*PasskeyOptionsCore, error)
+	FinishPasskeyRegistration(userId int, input PasskeyCredentialCore) error
+	BeginPasskeyLogin() (*PasskeyOptionsCore, error)
+	FinishPasskeyLogin(input PasskeyCredentialCore, session SessionCore) (data *Core, token *TokenCore, err error)
+	GetPasskeys(userId int) ([]PasskeyCore, error)
+	DeletePasskey(userId int, passkeyId uint) error
+}
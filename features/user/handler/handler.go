@@ -1,29 +1,39 @@
 package handler
 
 import (
+	"crypto/subtle"
+	"emailnotifl3n/app/config"
 	"emailnotifl3n/features/user"
 	"emailnotifl3n/utils/email"
 	"emailnotifl3n/utils/middlewares"
 	oauthfacebook "emailnotifl3n/utils/oauthFacebook"
 	"emailnotifl3n/utils/oauthGoogle"
+	"emailnotifl3n/utils/passwordpolicy"
 	"emailnotifl3n/utils/responses"
 	"emailnotifl3n/utils/upload"
+	"errors"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 )
 
 type UserHandler struct {
 	userService user.UserServiceInterface
+	cfg         *config.AppConfig
 	s3          upload.S3UploaderInterface
 	email       email.EmailInterface
 	oauthGoogle oauthGoogle.GoogleInterface
 	oauthFB     oauthfacebook.FacebookInterface
 }
 
-func New(service user.UserServiceInterface, s3Uploader upload.S3UploaderInterface, email email.EmailInterface, google oauthGoogle.GoogleInterface, fb oauthfacebook.FacebookInterface) *UserHandler {
+func New(service user.UserServiceInterface, s3Uploader upload.S3UploaderInterface, email email.EmailInterface, google oauthGoogle.GoogleInterface, fb oauthfacebook.FacebookInterface, cfg *config.AppConfig) *UserHandler {
 	return &UserHandler{
 		userService: service,
+		cfg:         cfg,
 		s3:          s3Uploader,
 		email:       email,
 		oauthGoogle: google,
@@ -41,7 +51,7 @@ func (handler *UserHandler) RegisterUser(c echo.Context) error {
 	userCore := RequestToCore(newUser)
 	errInsert := handler.userService.Create(userCore)
 	if errInsert != nil {
-		return c.JSON(http.StatusBadRequest, responses.WebResponse("error insert data. "+errInsert.Error(), nil))
+		return passwordErrorResponse(c, "error insert data. ", errInsert)
 	}
 
 	return c.JSON(http.StatusOK, responses.WebResponse("success insert user", nil))
@@ -53,14 +63,320 @@ func (handler *UserHandler) Login(c echo.Context) error {
 	if errBind != nil {
 		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
 	}
-	result, token, err := handler.userService.Login(reqData.Email, reqData.Password)
+	result, token, err := handler.userService.Login(reqData.Email, reqData.Password, RequestToSession(c))
+	var errBlocked *user.LoginBlockedError
+	if errors.As(err, &errBlocked) {
+		responseData := BlockedToResponse(errBlocked)
+		c.Response().Header().Set("Retry-After", strconv.Itoa(responseData.RetryAfter))
+		return c.JSON(http.StatusTooManyRequests, responses.WebResponse("error login. "+err.Error(), responseData))
+	}
+	if errors.Is(err, user.ErrAccountLocked) {
+		return c.JSON(http.StatusForbidden, responses.WebResponse("error login. "+err.Error(), nil))
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error login. "+err.Error(), nil))
+	}
+	if token.MfaToken != "" {
+		return c.JSON(http.StatusOK, responses.WebResponse("second factor required", TokenToMfaResponse(token)))
+	}
+	responseData := TokenToResponse(token, result.Name)
+	return c.JSON(http.StatusOK, responses.WebResponse("success login", responseData))
+}
+
+func (handler *UserHandler) RequestMagicLink(c echo.Context) error {
+	var reqData = ForgotPasswordRequest{}
+	errBind := c.Bind(&reqData)
+	if errBind != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
+	}
+
+	return handler.sendAccountEmail(c, reqData.Email, "sign in email sent", func() error {
+		user, token, err := handler.userService.RequestMagicLink(reqData.Email)
+		if err != nil {
+			return err
+		}
+
+		errSend := handler.email.SendMagicLink(user, token)
+		if errSend != nil {
+			return errors.New("error sending sign in email - " + errSend.Error())
+		}
+		return nil
+	})
+}
+
+func (handler *UserHandler) UnlockAccount(c echo.Context) error {
+	var reqData = TokenRequest{}
+	errBind := c.Bind(&reqData)
+	if errBind != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
+	}
+
+	errUnlock := handler.userService.UnlockAccount(reqData.Token)
+	if errUnlock != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error unlock account. "+errUnlock.Error(), nil))
+	}
+
+	return c.JSON(http.StatusOK, responses.WebResponse("success unlock account", nil))
+}
+
+func (handler *UserHandler) LockAccount(c echo.Context) error {
+	var reqData = TokenRequest{}
+	errBind := c.Bind(&reqData)
+	if errBind != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
+	}
+
+	errLock := handler.userService.LockAccount(reqData.Token)
+	if errLock != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error lock account. "+errLock.Error(), nil))
+	}
+
+	return c.JSON(http.StatusOK, responses.WebResponse("account locked, reset your password to unlock it", nil))
+}
+
+func (handler *UserHandler) LoginMagicLink(c echo.Context) error {
+	token := c.QueryParam("token")
+
+	result, tokens, err := handler.userService.LoginMagicLink(token, RequestToSession(c))
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, responses.WebResponse("error login. "+err.Error(), nil))
 	}
+	if tokens.MfaToken != "" {
+		return c.JSON(http.StatusOK, responses.WebResponse("second factor required", TokenToMfaResponse(tokens)))
+	}
+
+	responseData := TokenToResponse(tokens, result.Name)
+	return c.JSON(http.StatusOK, responses.WebResponse("success login", responseData))
+}
+
+func (handler *UserHandler) LoginSecondFactor(c echo.Context) error {
+	var reqData = SecondFactorRequest{}
+	errBind := c.Bind(&reqData)
+	if errBind != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
+	}
+
+	result, token, err := handler.userService.LoginSecondFactor(reqData.MfaToken, reqData.Code, RequestToSession(c))
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, responses.WebResponse("error login. "+err.Error(), nil))
+	}
+
+	responseData := TokenToResponse(token, result.Name)
+	return c.JSON(http.StatusOK, responses.WebResponse("success login", responseData))
+}
+
+func (handler *UserHandler) SetupTotp(c echo.Context) error {
+	userIdLogin := middlewares.ExtractTokenUserId(c)
+
+	secret, uri, err := handler.userService.SetupTotp(userIdLogin)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error setup 2FA. "+err.Error(), nil))
+	}
+
+	responseData := TotpSetupResponse{
+		Secret: secret,
+		URI:    uri,
+	}
+	return c.JSON(http.StatusOK, responses.WebResponse("scan the uri with your authenticator app and confirm with a code", responseData))
+}
+
+func (handler *UserHandler) SetEmailOtp(c echo.Context) error {
+	userIdLogin := middlewares.ExtractTokenUserId(c)
+
+	var reqData = EmailOtpRequest{}
+	errBind := c.Bind(&reqData)
+	if errBind != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
+	}
+
+	errUpdate := handler.userService.SetEmailOtp(userIdLogin, reqData.Enabled)
+	if errUpdate != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error update email 2FA. "+errUpdate.Error(), nil))
+	}
+
+	return c.JSON(http.StatusOK, responses.WebResponse("success update email 2FA", nil))
+}
+
+func (handler *UserHandler) ConfirmTotp(c echo.Context) error {
+	userIdLogin := middlewares.ExtractTokenUserId(c)
+
+	var reqData = CodeConfirmRequest{}
+	errBind := c.Bind(&reqData)
+	if errBind != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
+	}
+
+	recoveryCodes, err := handler.userService.ConfirmTotp(userIdLogin, reqData.Code)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error confirm 2FA. "+err.Error(), nil))
+	}
+
 	responseData := map[string]any{
-		"token": token,
-		"nama":  result.Name,
+		"recovery_codes": recoveryCodes,
+	}
+	return c.JSON(http.StatusOK, responses.WebResponse("2FA enabled, store the recovery codes somewhere safe", responseData))
+}
+
+func (handler *UserHandler) RefreshToken(c echo.Context) error {
+	var reqData = RefreshTokenRequest{}
+	errBind := c.Bind(&reqData)
+	if errBind != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
+	}
+
+	token, err := handler.userService.RefreshToken(reqData.RefreshToken)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, responses.WebResponse("error refresh token. "+err.Error(), nil))
+	}
+
+	responseData := TokenToResponse(token, "")
+	return c.JSON(http.StatusOK, responses.WebResponse("success refresh token", responseData))
+}
+
+func (handler *UserHandler) Logout(c echo.Context) error {
+	claims := middlewares.ExtractTokenClaims(c)
+
+	errLogout := handler.userService.Logout(claims.UserID, claims.SessionID, claims.JTI, claims.ExpiresAt)
+	if errLogout != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error logout. "+errLogout.Error(), nil))
+	}
+
+	return c.JSON(http.StatusOK, responses.WebResponse("success logout", nil))
+}
+
+func (handler *UserHandler) GetSessions(c echo.Context) error {
+	claims := middlewares.ExtractTokenClaims(c)
+
+	result, errSelect := handler.userService.GetSessions(claims.UserID)
+	if errSelect != nil {
+		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error read data. "+errSelect.Error(), nil))
+	}
+
+	var sessionsResult []SessionResponse
+	for _, v := range result {
+		sessionsResult = append(sessionsResult, CoreToSessionResponse(v, claims.SessionID))
+	}
+	return c.JSON(http.StatusOK, responses.WebResponse("success read data", sessionsResult))
+}
+
+func (handler *UserHandler) DeleteSession(c echo.Context) error {
+	claims := middlewares.ExtractTokenClaims(c)
+
+	sessionId, errConv := strconv.Atoi(c.Param("id"))
+	if errConv != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error. id should be number", nil))
+	}
+
+	errDelete := handler.userService.EndSession(claims.UserID, uint(sessionId))
+	if errDelete != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error end session. "+errDelete.Error(), nil))
+	}
+
+	return c.JSON(http.StatusOK, responses.WebResponse("success end session", nil))
+}
+
+func (handler *UserHandler) DeleteOtherSessions(c echo.Context) error {
+	claims := middlewares.ExtractTokenClaims(c)
+
+	errDelete := handler.userService.EndOtherSessions(claims.UserID, claims.SessionID)
+	if errDelete != nil {
+		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error end sessions. "+errDelete.Error(), nil))
+	}
+
+	return c.JSON(http.StatusOK, responses.WebResponse("success end other sessions", nil))
+}
+
+func (handler *UserHandler) BeginPasskeyRegistration(c echo.Context) error {
+	userIdLogin := middlewares.ExtractTokenUserId(c)
+
+	result, err := handler.userService.BeginPasskeyRegistration(userIdLogin)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error register passkey. "+err.Error(), nil))
+	}
+
+	return c.JSON(http.StatusOK, responses.WebResponse("pass publicKey to navigator.credentials.create()", CoreToPasskeyCreationResponse(result)))
+}
+
+func (handler *UserHandler) FinishPasskeyRegistration(c echo.Context) error {
+	userIdLogin := middlewares.ExtractTokenUserId(c)
+
+	var passkeyReq PasskeyRequest
+	errBind := c.Bind(&passkeyReq)
+	if errBind != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
 	}
+
+	passkeyCore, errDecode := PasskeyRequestToCore(passkeyReq)
+	if errDecode != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
+	}
+
+	errRegister := handler.userService.FinishPasskeyRegistration(userIdLogin, passkeyCore)
+	if errRegister != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error register passkey. "+errRegister.Error(), nil))
+	}
+
+	return c.JSON(http.StatusOK, responses.WebResponse("success register passkey", nil))
+}
+
+func (handler *UserHandler) GetPasskeys(c echo.Context) error {
+	userIdLogin := middlewares.ExtractTokenUserId(c)
+
+	result, errSelect := handler.userService.GetPasskeys(userIdLogin)
+	if errSelect != nil {
+		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error read data. "+errSelect.Error(), nil))
+	}
+
+	var passkeysResult []PasskeyResponse
+	for _, v := range result {
+		passkeysResult = append(passkeysResult, CoreToPasskeyResponse(v))
+	}
+	return c.JSON(http.StatusOK, responses.WebResponse("success read data", passkeysResult))
+}
+
+func (handler *UserHandler) DeletePasskey(c echo.Context) error {
+	userIdLogin := middlewares.ExtractTokenUserId(c)
+
+	passkeyId, errConv := strconv.Atoi(c.Param("id"))
+	if errConv != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error. id should be number", nil))
+	}
+
+	errDelete := handler.userService.DeletePasskey(userIdLogin, uint(passkeyId))
+	if errDelete != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error delete passkey. "+errDelete.Error(), nil))
+	}
+
+	return c.JSON(http.StatusOK, responses.WebResponse("success delete passkey", nil))
+}
+
+func (handler *UserHandler) BeginPasskeyLogin(c echo.Context) error {
+	result, err := handler.userService.BeginPasskeyLogin()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error login. "+err.Error(), nil))
+	}
+
+	return c.JSON(http.StatusOK, responses.WebResponse("pass publicKey to navigator.credentials.get()", CoreToPasskeyRequestResponse(result)))
+}
+
+func (handler *UserHandler) FinishPasskeyLogin(c echo.Context) error {
+	var passkeyReq PasskeyRequest
+	errBind := c.Bind(&passkeyReq)
+	if errBind != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
+	}
+
+	passkeyCore, errDecode := PasskeyRequestToCore(passkeyReq)
+	if errDecode != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
+	}
+
+	data, token, err := handler.userService.FinishPasskeyLogin(passkeyCore, RequestToSession(c))
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, responses.WebResponse("error login. "+err.Error(), nil))
+	}
+
+	responseData := TokenToResponse(token, data.Name)
 	return c.JSON(http.StatusOK, responses.WebResponse("success login", responseData))
 }
 
@@ -107,6 +423,75 @@ func (handler *UserHandler) UpdateUser(c echo.Context) error {
 	return c.JSON(http.StatusOK, responses.WebResponse("success update data", nil))
 }
 
+func (handler *UserHandler) RequestEmailChange(c echo.Context) error {
+	userIdLogin := middlewares.ExtractTokenUserId(c)
+
+	var reqData = ChangeEmailRequest{}
+	errBind := c.Bind(&reqData)
+	if errBind != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data. data not valid", nil))
+	}
+
+	result, change, err := handler.userService.RequestEmailChange(userIdLogin, reqData.Email, reqData.Password)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error change email. "+err.Error(), nil))
+	}
+
+	errSend := handler.email.SendEmailChangeConfirmation(result, change.NewEmail, change.ConfirmToken, change.Code)
+	if errSend != nil {
+		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error sending confirmation email - "+errSend.Error(), nil))
+	}
+
+	errSend = handler.email.SendEmailChangeNotice(result, change.NewEmail, change.CancelToken)
+	if errSend != nil {
+		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error sending email change notice - "+errSend.Error(), nil))
+	}
+
+	return c.JSON(http.StatusOK, responses.WebResponse("confirmation email sent to the new address", nil))
+}
+
+func (handler *UserHandler) ConfirmEmailChange(c echo.Context) error {
+	var reqData = TokenRequest{}
+	errBind := c.Bind(&reqData)
+	if errBind != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
+	}
+
+	errConfirm := handler.userService.ConfirmEmailChange(reqData.Token)
+	if errConfirm != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error confirm email change. "+errConfirm.Error(), nil))
+	}
+
+	return c.JSON(http.StatusOK, responses.WebResponse("success change email, please sign in again", nil))
+}
+
+func (handler *UserHandler) ConfirmEmailChangeCode(c echo.Context) error {
+	claims := middlewares.ExtractTokenClaims(c)
+	code := c.QueryParam("code")
+
+	errConfirm := handler.userService.ConfirmEmailChangeCode(claims.UserID, claims.SessionID, code)
+	if errConfirm != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error confirm email change. "+errConfirm.Error(), nil))
+	}
+
+	return c.JSON(http.StatusOK, responses.WebResponse("success change email", nil))
+}
+
+func (handler *UserHandler) CancelEmailChange(c echo.Context) error {
+	var reqData = TokenRequest{}
+	errBind := c.Bind(&reqData)
+	if errBind != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
+	}
+
+	errCancel := handler.userService.CancelEmailChange(reqData.Token)
+	if errCancel != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error cancel email change. "+errCancel.Error(), nil))
+	}
+
+	return c.JSON(http.StatusOK, responses.WebResponse("email change cancelled", nil))
+}
+
 func (handler *UserHandler) DeleteUser(c echo.Context) error {
 	userIdLogin := middlewares.ExtractTokenUserId(c)
 
@@ -119,7 +504,7 @@ func (handler *UserHandler) DeleteUser(c echo.Context) error {
 }
 
 func (handler *UserHandler) ChangePassword(c echo.Context) error {
-	userIdLogin := middlewares.ExtractTokenUserId(c)
+	claims := middlewares.ExtractTokenClaims(c)
 
 	var passwords = ChangePasswordRequest{}
 	errBind := c.Bind(&passwords)
@@ -127,9 +512,9 @@ func (handler *UserHandler) ChangePassword(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data. data not valid", nil))
 	}
 
-	errChange := handler.userService.ChangePassword(userIdLogin, passwords.OldPassword, passwords.NewPassword)
+	errChange := handler.userService.ChangePassword(claims.UserID, claims.SessionID, passwords.OldPassword, passwords.NewPassword)
 	if errChange != nil {
-		return c.JSON(http.StatusBadRequest, responses.WebResponse("error change password. "+errChange.Error(), nil))
+		return passwordErrorResponse(c, "error change password. ", errChange)
 	}
 
 	return c.JSON(http.StatusOK, responses.WebResponse("success change password", nil))
@@ -142,26 +527,23 @@ func (handler *UserHandler) ForgotPassword(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data. data not valid", nil))
 	}
 
-	user, token, err := handler.userService.ForgotPassword(ForgotReq.Email)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, responses.WebResponse(err.Error(), nil))
-	}
+	return handler.sendAccountEmail(c, ForgotReq.Email, "reset password email sent", func() error {
+		user, token, err := handler.userService.ForgotPassword(ForgotReq.Email)
+		if err != nil {
+			return err
+		}
 
-	errForgot := handler.email.SendResetPasswordLink(user, token)
-	if errForgot != nil {
-		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error sending reset password email - "+errForgot.Error(), nil))
-	}
-	return c.JSON(http.StatusOK, responses.WebResponse("reset password email sent", nil))
+		errForgot := handler.email.SendResetPasswordLink(user, token)
+		if errForgot != nil {
+			return errors.New("error sending reset password email - " + errForgot.Error())
+		}
+		return nil
+	})
 }
 
 func (handler *UserHandler) ResetPassword(c echo.Context) error {
 	token := c.QueryParam("token")
 
-	userId, err := middlewares.ExtractUserIdFromResetPasswordToken(token)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, responses.WebResponse("error extracting user id from reset password token. "+err.Error(), nil))
-	}
-
 	var resetPasswordRequest = ResetPasswordRequest{}
 	errBind := c.Bind(&resetPasswordRequest)
 	if errBind != nil {
@@ -172,9 +554,9 @@ func (handler *UserHandler) ResetPassword(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, responses.WebResponse("new password and confirm password do not match", nil))
 	}
 
-	errReset := handler.userService.ResetPassword(userId, resetPasswordRequest.NewPassword)
+	errReset := handler.userService.ResetPassword(token, resetPasswordRequest.NewPassword)
 	if errReset != nil {
-		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error reset password. "+errReset.Error(), nil))
+		return passwordErrorResponse(c, "error reset password. ", errReset)
 	}
 
 	return c.JSON(http.StatusOK, responses.WebResponse("success reset password", nil))
@@ -187,29 +569,26 @@ func (handler *UserHandler) SendVerifyEmail(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data. data not valid", nil))
 	}
 
-	user, token, err := handler.userService.ForgotPassword(ForgotReq.Email)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, responses.WebResponse(err.Error(), nil))
-	}
+	return handler.sendAccountEmail(c, ForgotReq.Email, "verification email sent", func() error {
+		user, token, err := handler.userService.RequestVerifyEmail(ForgotReq.Email)
+		if err != nil {
+			return err
+		}
 
-	errForgot := handler.email.SendVerificationLink(user, token)
-	if errForgot != nil {
-		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error sending reset password email - "+errForgot.Error(), nil))
-	}
-	return c.JSON(http.StatusOK, responses.WebResponse("verification email sent", nil))
+		errForgot := handler.email.SendVerificationLink(user, token)
+		if errForgot != nil {
+			return errors.New("error sending verification email - " + errForgot.Error())
+		}
+		return nil
+	})
 }
 
 func (handler *UserHandler) VerifyEmailLink(c echo.Context) error {
 	token := c.QueryParam("token")
 
-	userId, err := middlewares.ExtractUserIdFromResetPasswordToken(token)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, responses.WebResponse("error extracting user id from reset password token. "+err.Error(), nil))
-	}
-
-	errReset := handler.userService.VerifyEmailLink(userId)
-	if errReset != nil {
-		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error reset password. "+errReset.Error(), nil))
+	errVerify := handler.userService.VerifyEmailLink(token)
+	if errVerify != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error verification email. "+errVerify.Error(), nil))
 	}
 
 	return c.JSON(http.StatusOK, responses.WebResponse("success verification email", nil))
@@ -222,17 +601,18 @@ func (handler *UserHandler) RequestCodePassword(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
 	}
 
-	userCore := CoderequestToCore(reqData)
-	user, err := handler.userService.RequestCode(userCore.Email, userCore.Code)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, responses.WebResponse(err.Error(), nil))
-	}
+	return handler.sendAccountEmail(c, reqData.Email, "code email sent", func() error {
+		result, code, err := handler.userService.RequestCode(user.CodePurposeResetPassword, reqData.Email)
+		if err != nil {
+			return err
+		}
 
-	errForgot := handler.email.SendCodeResetPassword(user, userCore.Code)
-	if errForgot != nil {
-		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error sending code - "+errForgot.Error(), nil))
-	}
-	return c.JSON(http.StatusOK, responses.WebResponse("code email sent", nil))
+		errForgot := handler.email.SendCodeResetPassword(result, code)
+		if errForgot != nil {
+			return errors.New("error sending code - " + errForgot.Error())
+		}
+		return nil
+	})
 }
 
 func (handler *UserHandler) RequestCodeVerify(c echo.Context) error {
@@ -242,17 +622,44 @@ func (handler *UserHandler) RequestCodeVerify(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
 	}
 
-	userCore := CoderequestToCore(reqData)
-	user, err := handler.userService.RequestCode(userCore.Email, userCore.Code)
-	if err != nil {
-		return c.JSON(http.StatusInternalServerError, responses.WebResponse(err.Error(), nil))
-	}
+	return handler.sendAccountEmail(c, reqData.Email, "code email sent", func() error {
+		result, code, err := handler.userService.RequestCode(user.CodePurposeVerifyEmail, reqData.Email)
+		if err != nil {
+			return err
+		}
 
-	errForgot := handler.email.SendCodeResetEmail(user, userCore.Code)
-	if errForgot != nil {
-		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error sending code - "+errForgot.Error(), nil))
+		errForgot := handler.email.SendCodeResetEmail(result, code)
+		if errForgot != nil {
+			return errors.New("error sending code - " + errForgot.Error())
+		}
+		return nil
+	})
+}
+
+// sendAccountEmail runs send, which looks up email and mails it. In anti-enumeration mode send runs in
+// the background and every address gets the same answer in about the same time, registered or not.
+func (handler *UserHandler) sendAccountEmail(c echo.Context, email string, message string, send func() error) error {
+	if !handler.cfg.ANTI_ENUMERATION {
+		err := send()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, responses.WebResponse(err.Error(), nil))
+		}
+		return c.JSON(http.StatusOK, responses.WebResponse(message, nil))
 	}
-	return c.JSON(http.StatusOK, responses.WebResponse("code email sent", nil))
+
+	go func() {
+		err := send()
+		if errors.Is(err, user.ErrEmailNotFound) {
+			if !handler.cfg.UNKNOWN_EMAIL_NOTICE || email == "" {
+				return
+			}
+			err = handler.email.SendUnknownAccountNotice(email)
+		}
+		if err != nil {
+			log.Println("error sending account email:", err.Error())
+		}
+	}()
+	return c.JSON(http.StatusOK, responses.WebResponse("if the email is registered, an email is on its way", nil))
 }
 
 func (handler *UserHandler) ResetPasswordCode(c echo.Context) error {
@@ -270,7 +677,7 @@ func (handler *UserHandler) ResetPasswordCode(c echo.Context) error {
 
 	errReset := handler.userService.ResetPasswordCode(resetPasswordRequest.Email, resetPasswordRequest.NewPassword, code)
 	if errReset != nil {
-		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error reset password. "+errReset.Error(), nil))
+		return passwordErrorResponse(c, "error reset password. ", errReset)
 	}
 
 	return c.JSON(http.StatusOK, responses.WebResponse("success reset password", nil))
@@ -294,53 +701,295 @@ func (handler *UserHandler) VerifyEmailCode(c echo.Context) error {
 }
 
 func (handler *UserHandler) GoogleLoginRedirect(c echo.Context) error {
-	url := handler.oauthGoogle.GetAuthURL()
+	url, err := handler.beginOAuth(c, user.LoginMethodGoogle, 0)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error start Google OAuth. "+err.Error(), nil))
+	}
 	return c.Redirect(http.StatusTemporaryRedirect, url)
 }
 
 func (handler *UserHandler) RegisterWithGoogle(c echo.Context) error {
 	code := c.QueryParam("code")
 
-	googleOauthToken, err := handler.oauthGoogle.GetGoogleOauthToken(code)
+	state, err := handler.finishOAuth(c, user.LoginMethodGoogle)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error getting Google OAuth token: "+err.Error(), nil))
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error Google OAuth. "+err.Error(), nil))
 	}
 
-	googleUser, err := handler.oauthGoogle.GetGoogleUser(googleOauthToken.Access_token, googleOauthToken.Id_token)
+	googleOauthToken, err := handler.oauthGoogle.GetGoogleOauthToken(code, state.Verifier)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error getting Google user: "+err.Error(), nil))
+		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error getting Google OAuth token: "+err.Error(), nil))
 	}
 
-	errInsert := handler.userService.RegisterGoogle(*googleUser)
-	if errInsert != nil {
-		return c.JSON(http.StatusBadRequest, responses.WebResponse("error insert data. "+errInsert.Error(), nil))
+	googleUser, identity, err := handler.oauthGoogle.GetGoogleUser(googleOauthToken.Access_token, googleOauthToken.Id_token)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error getting Google user: "+err.Error(), nil))
 	}
 
-	return c.JSON(http.StatusOK, responses.WebResponse("success register user", googleUser))
+	return handler.completeOAuth(c, state, googleUser, identity)
 }
 
 func (handler *UserHandler) FacebookRedirect(c echo.Context) error {
-	url := handler.oauthFB.GetAuthURL()
+	url, err := handler.beginOAuth(c, user.LoginMethodFacebook, 0)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error start fb OAuth. "+err.Error(), nil))
+	}
 	return c.Redirect(http.StatusTemporaryRedirect, url)
 }
 
 func (handler *UserHandler) RegisterWithFacebook(c echo.Context) error {
 	code := c.QueryParam("code")
 
-	fbOauthToken, err := handler.oauthFB.GetFacebookOauthToken(code)
+	state, err := handler.finishOAuth(c, user.LoginMethodFacebook)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error fb OAuth. "+err.Error(), nil))
+	}
+
+	fbOauthToken, err := handler.oauthFB.GetFacebookOauthToken(code, state.Verifier)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error getting fb OAuth token: "+err.Error(), nil))
 	}
 
-	fbUser, err := handler.oauthFB.GetFacebookUser(fbOauthToken.Access_token)
+	fbUser, identity, err := handler.oauthFB.GetFacebookUser(fbOauthToken.Access_token)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error getting fb user: "+err.Error(), nil))
 	}
 
-	errInsert := handler.userService.RegisterGoogle(*fbUser)
-	if errInsert != nil {
-		return c.JSON(http.StatusBadRequest, responses.WebResponse("error insert data. "+errInsert.Error(), nil))
+	return handler.completeOAuth(c, state, fbUser, identity)
+}
+
+// completeOAuth signs the provider account in, or links it when the redirect was
+// started from LinkIdentity
+func (handler *UserHandler) completeOAuth(c echo.Context, state *user.OAuthStateCore, profile *user.Core, identity *user.IdentityCore) error {
+	if state.LinkUserID != 0 {
+		errLink := handler.userService.LinkIdentity(int(state.LinkUserID), *identity)
+		if errLink != nil {
+			return c.JSON(http.StatusBadRequest, responses.WebResponse("error link identity. "+errLink.Error(), nil))
+		}
+		return oauthLinkResponse(c, state)
+	}
+
+	result, token, errLogin := handler.userService.LoginWithProvider(*profile, *identity, RequestToSession(c))
+	var errLinkRequired *user.LinkRequiredError
+	if errors.As(errLogin, &errLinkRequired) {
+		return oauthLinkRequiredResponse(c, state, errLinkRequired)
+	}
+	if errors.Is(errLogin, user.ErrAccountLocked) || errors.Is(errLogin, user.ErrProviderEmailUnverified) {
+		return c.JSON(http.StatusForbidden, responses.WebResponse("error login. "+errLogin.Error(), nil))
+	}
+	if errLogin != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error login. "+errLogin.Error(), nil))
+	}
+
+	return oauthLoginResponse(c, state, result, token)
+}
+
+func (handler *UserHandler) RequestLinkCode(c echo.Context) error {
+	var reqData = LinkCodeRequest{}
+	errBind := c.Bind(&reqData)
+	if errBind != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
+	}
+
+	result, code, err := handler.userService.RequestLinkCode(reqData.LinkToken)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error request code. "+err.Error(), nil))
+	}
+
+	errSend := handler.email.SendLinkCode(result, code)
+	if errSend != nil {
+		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error sending code - "+errSend.Error(), nil))
+	}
+	return c.JSON(http.StatusOK, responses.WebResponse("code email sent", nil))
+}
+
+func (handler *UserHandler) ConfirmLink(c echo.Context) error {
+	var reqData = ConfirmLinkRequest{}
+	errBind := c.Bind(&reqData)
+	if errBind != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error bind data, data not valid", nil))
 	}
 
-	return c.JSON(http.StatusOK, responses.WebResponse("success register user", fbUser))
-}
\ No newline at end of file
+	result, token, err := handler.userService.ConfirmLink(reqData.LinkToken, reqData.Password, reqData.Code, RequestToSession(c))
+	var errBlocked *user.LoginBlockedError
+	if errors.As(err, &errBlocked) {
+		responseData := BlockedToResponse(errBlocked)
+		c.Response().Header().Set("Retry-After", strconv.Itoa(responseData.RetryAfter))
+		return c.JSON(http.StatusTooManyRequests, responses.WebResponse("error link identity. "+err.Error(), responseData))
+	}
+	if errors.Is(err, user.ErrAccountLocked) {
+		return c.JSON(http.StatusForbidden, responses.WebResponse("error link identity. "+err.Error(), nil))
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error link identity. "+err.Error(), nil))
+	}
+	if token.MfaToken != "" {
+		return c.JSON(http.StatusOK, responses.WebResponse("second factor required", TokenToMfaResponse(token)))
+	}
+	responseData := TokenToResponse(token, result.Name)
+	return c.JSON(http.StatusOK, responses.WebResponse("success login", responseData))
+}
+
+func (handler *UserHandler) GetIdentities(c echo.Context) error {
+	userIdLogin := middlewares.ExtractTokenUserId(c)
+
+	result, errSelect := handler.userService.GetIdentities(userIdLogin)
+	if errSelect != nil {
+		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error read data. "+errSelect.Error(), nil))
+	}
+
+	var identitiesResult []IdentityResponse
+	for _, v := range result {
+		identitiesResult = append(identitiesResult, CoreToIdentityResponse(v))
+	}
+	return c.JSON(http.StatusOK, responses.WebResponse("success read data", identitiesResult))
+}
+
+// LinkIdentity answers the provider url to open, the identity is linked on its callback
+func (handler *UserHandler) LinkIdentity(c echo.Context) error {
+	userIdLogin := middlewares.ExtractTokenUserId(c)
+
+	url, err := handler.beginOAuth(c, c.Param("provider"), userIdLogin)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error link identity. "+err.Error(), nil))
+	}
+	return c.JSON(http.StatusOK, responses.WebResponse("open the url to link the identity", IdentityLinkResponse{URL: url}))
+}
+
+func (handler *UserHandler) UnlinkIdentity(c echo.Context) error {
+	userIdLogin := middlewares.ExtractTokenUserId(c)
+
+	identityId, errConv := strconv.Atoi(c.Param("id"))
+	if errConv != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error. id should be number", nil))
+	}
+
+	errUnlink := handler.userService.UnlinkIdentity(userIdLogin, uint(identityId))
+	if errUnlink != nil {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse("error unlink identity. "+errUnlink.Error(), nil))
+	}
+
+	return c.JSON(http.StatusOK, responses.WebResponse("success unlink identity", nil))
+}
+
+// oauthStateCookie ties the state of an oauth redirect to the browser that started it
+const oauthStateCookie = "oauth_state"
+
+// beginOAuth creates the state of a redirect to provider, sets it as a cookie
+// and returns the url of the provider
+func (handler *UserHandler) beginOAuth(c echo.Context, provider string, linkUserId int) (string, error) {
+	state, err := handler.userService.BeginOAuth(provider, c.QueryParam("redirect_uri"), linkUserId)
+	if err != nil {
+		return "", err
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state.State,
+		Path:     "/",
+		MaxAge:   int(handler.cfg.OAUTH_STATE_TTL.Seconds()),
+		HttpOnly: true,
+		Secure:   c.Scheme() == "https",
+		// the callback is a top-level navigation coming from the provider
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	if provider == user.LoginMethodFacebook {
+		return handler.oauthFB.GetAuthURL(state.State, state.Verifier), nil
+	}
+	return handler.oauthGoogle.GetAuthURL(state.State, state.Verifier), nil
+}
+
+// finishOAuth checks the state of a callback against the cookie and consumes it
+func (handler *UserHandler) finishOAuth(c echo.Context, provider string) (*user.OAuthStateCore, error) {
+	state := c.QueryParam("state")
+	cookie, err := c.Cookie(oauthStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		return nil, errors.New("state does not match")
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     oauthStateCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	return handler.userService.FinishOAuth(provider, state)
+}
+
+// oauthLinkResponse answers the callback of a link, or redirects to its redirect_uri
+func oauthLinkResponse(c echo.Context, state *user.OAuthStateCore) error {
+	if state.RedirectURI == "" {
+		return c.JSON(http.StatusOK, responses.WebResponse("success link identity", nil))
+	}
+
+	target, err := url.Parse(state.RedirectURI)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error redirect_uri. "+err.Error(), nil))
+	}
+
+	fragment := url.Values{}
+	fragment.Set("linked", state.Provider)
+	target.Fragment = fragment.Encode()
+	return c.Redirect(http.StatusFound, target.String())
+}
+
+// oauthLinkRequiredResponse answers 409 with the link token, or passes it to the redirect_uri
+func oauthLinkRequiredResponse(c echo.Context, state *user.OAuthStateCore, errLink *user.LinkRequiredError) error {
+	responseData := LinkRequiredToResponse(errLink)
+	if state.RedirectURI == "" {
+		return c.JSON(http.StatusConflict, responses.WebResponse(errLink.Error(), responseData))
+	}
+
+	target, err := url.Parse(state.RedirectURI)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error redirect_uri. "+err.Error(), nil))
+	}
+
+	fragment := url.Values{}
+	fragment.Set("link_token", responseData.LinkToken)
+	fragment.Set("provider", responseData.Provider)
+	fragment.Set("email", responseData.Email)
+	fragment.Set("methods", strings.Join(responseData.Methods, ","))
+	target.Fragment = fragment.Encode()
+	return c.Redirect(http.StatusFound, target.String())
+}
+
+// oauthLoginResponse answers an oauth callback like Login does, or redirects to the
+// redirect_uri the state carries with the same fields in the URL fragment
+func oauthLoginResponse(c echo.Context, state *user.OAuthStateCore, result *user.Core, token *user.TokenCore) error {
+	if state.RedirectURI == "" {
+		if token.MfaToken != "" {
+			return c.JSON(http.StatusOK, responses.WebResponse("second factor required", TokenToMfaResponse(token)))
+		}
+		return c.JSON(http.StatusOK, responses.WebResponse("success login", TokenToResponse(token, result.Name)))
+	}
+
+	target, err := url.Parse(state.RedirectURI)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, responses.WebResponse("error redirect_uri. "+err.Error(), nil))
+	}
+
+	// fragments are not sent to servers, so the tokens stay out of access logs
+	fragment := url.Values{}
+	fragment.Set("expires_in", strconv.FormatInt(token.ExpiresIn, 10))
+	if token.MfaToken != "" {
+		fragment.Set("mfa_token", token.MfaToken)
+		fragment.Set("mfa_method", token.MfaMethod)
+	} else {
+		fragment.Set("token", token.AccessToken)
+		fragment.Set("refresh_token", token.RefreshToken)
+		fragment.Set("name", result.Name)
+	}
+	target.Fragment = fragment.Encode()
+	return c.Redirect(http.StatusFound, target.String())
+}
+
+// passwordErrorResponse answers 400 and lists the broken rules when the password policy rejected the password
+func passwordErrorResponse(c echo.Context, message string, err error) error {
+	var errPolicy *passwordpolicy.PolicyError
+	if errors.As(err, &errPolicy) {
+		return c.JSON(http.StatusBadRequest, responses.WebResponse(message+err.Error(), errPolicy.Violations))
+	}
+	return c.JSON(http.StatusBadRequest, responses.WebResponse(message+err.Error(), nil))
+}
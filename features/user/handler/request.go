@@ -2,9 +2,10 @@ package handler
 
 import (
 	"emailnotifl3n/features/user"
-	"fmt"
+	"encoding/base64"
+	"strings"
 
-	"golang.org/x/exp/rand"
+	"github.com/labstack/echo/v4"
 )
 
 type UserRequest struct {
@@ -19,6 +20,39 @@ type LoginRequest struct {
 	Password string `json:"password" form:"password"`
 }
 
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" form:"refresh_token"`
+}
+
+type SecondFactorRequest struct {
+	MfaToken string `json:"mfa_token" form:"mfa_token"`
+	Code     string `json:"code" form:"code"`
+}
+
+type EmailOtpRequest struct {
+	Enabled bool `json:"enabled" form:"enabled"`
+}
+
+type CodeConfirmRequest struct {
+	Code string `json:"code" form:"code"`
+}
+
+// PublicKeyCredential as serialized by the browser, binary fields base64url encoded
+type PasskeyRequest struct {
+	ChallengeID string                 `json:"challenge_id"`
+	Name        string                 `json:"name"`
+	ID          string                 `json:"id"`
+	Response    PasskeyResponseRequest `json:"response"`
+}
+
+type PasskeyResponseRequest struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle"`
+}
+
 type ChangePasswordRequest struct {
 	OldPassword string `json:"old_password" form:"old_password"`
 	NewPassword string `json:"new_password" form:"new_password"`
@@ -39,9 +73,29 @@ type ResetPasswordRequestCode struct {
 	ConfirmPassword string `json:"confirm_password"`
 }
 
+// TokenRequest carries the token of an email link, the linked page submits it
+// so mail scanners opening the link don't use it up
+type TokenRequest struct {
+	Token string `json:"token" form:"token"`
+}
+
 type CodeRequest struct {
 	Email string `json:"email" form:"email"`
-	Code  string
+}
+
+type ChangeEmailRequest struct {
+	Email    string `json:"email" form:"email"`
+	Password string `json:"password" form:"password"`
+}
+
+type LinkCodeRequest struct {
+	LinkToken string `json:"link_token" form:"link_token"`
+}
+
+type ConfirmLinkRequest struct {
+	LinkToken string `json:"link_token" form:"link_token"`
+	Password  string `json:"password" form:"password"`
+	Code      string `json:"code" form:"code"`
 }
 
 func RequestToCore(input UserRequest) user.Core {
@@ -66,19 +120,40 @@ func UpdateRequestToCore(input UserRequest, imageURL string) user.Core {
 func UpdateRequestToCoreUpdate(input UserRequest, imageURL string) user.CoreUpdate {
 	return user.CoreUpdate{
 		Name:         input.Name,
-		Email:        input.Email,
 		PhotoProfile: imageURL,
 	}
 }
 
-func generateCode() string {
-	num := rand.Intn(900000) + 100000
-	return fmt.Sprintf("%06d", num)
+func RequestToSession(c echo.Context) user.SessionCore {
+	return user.SessionCore{
+		UserAgent: c.Request().UserAgent(),
+		IPAddress: c.RealIP(),
+	}
 }
 
-func CoderequestToCore(input CodeRequest) user.Core {
-	return user.Core{
-		Code:  generateCode(),
-		Email: input.Email,
+func PasskeyRequestToCore(input PasskeyRequest) (user.PasskeyCredentialCore, error) {
+	result := user.PasskeyCredentialCore{
+		ChallengeID:  input.ChallengeID,
+		Name:         input.Name,
+		CredentialID: strings.TrimRight(input.ID, "="),
+	}
+
+	fields := []struct {
+		value  string
+		target *[]byte
+	}{
+		{input.Response.ClientDataJSON, &result.ClientDataJSON},
+		{input.Response.AttestationObject, &result.AttestationObject},
+		{input.Response.AuthenticatorData, &result.AuthenticatorData},
+		{input.Response.Signature, &result.Signature},
+		{input.Response.UserHandle, &result.UserHandle},
+	}
+	for _, v := range fields {
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(v.value, "="))
+		if err != nil {
+			return result, err
+		}
+		*v.target = decoded
 	}
+	return result, nil
 }
@@ -1,6 +1,10 @@
 package handler
 
-import "emailnotifl3n/features/user"
+import (
+	"emailnotifl3n/features/user"
+	"math"
+	"time"
+)
 
 type UserResponse struct {
 	ID           uint   `json:"id" form:"id"`
@@ -15,12 +19,239 @@ type UserKosDetailResponse struct {
 	PhotoProfile string `json:"photo_profile" form:"photo_profile"`
 }
 
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Name         string `json:"nama,omitempty"`
+}
+
+type LoginBlockedResponse struct {
+	RetryAt    time.Time `json:"retry_at"`
+	RetryAfter int       `json:"retry_after"`
+}
+
+type MfaResponse struct {
+	MfaToken  string `json:"mfa_token"`
+	MfaMethod string `json:"mfa_method"`
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+type TotpSetupResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type SessionResponse struct {
+	ID          uint      `json:"id"`
+	UserAgent   string    `json:"user_agent"`
+	IPAddress   string    `json:"ip_address"`
+	LoginMethod string    `json:"login_method"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+	Current     bool      `json:"current"`
+}
+
+type PasskeyResponse struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+type IdentityResponse struct {
+	ID       uint      `json:"id"`
+	Provider string    `json:"provider"`
+	Email    string    `json:"email"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+type IdentityLinkResponse struct {
+	URL string `json:"url"`
+}
+
+type LinkRequiredResponse struct {
+	LinkToken string   `json:"link_token"`
+	Provider  string   `json:"provider"`
+	Email     string   `json:"email"`
+	Methods   []string `json:"methods"`
+}
+
+type PasskeyOptionsResponse struct {
+	ChallengeID string `json:"challenge_id,omitempty"`
+	PublicKey   any    `json:"publicKey"`
+}
+
+// PublicKeyCredentialCreationOptions for navigator.credentials.create()
+type PasskeyCreationOptions struct {
+	Challenge              string                     `json:"challenge"`
+	RP                     PasskeyRelyingParty        `json:"rp"`
+	User                   PasskeyUser                `json:"user"`
+	PubKeyCredParams       []PasskeyCredentialParam   `json:"pubKeyCredParams"`
+	Timeout                int64                      `json:"timeout"`
+	Attestation            string                     `json:"attestation"`
+	ExcludeCredentials     []PasskeyCredentialDesc    `json:"excludeCredentials"`
+	AuthenticatorSelection PasskeyAuthenticatorSelect `json:"authenticatorSelection"`
+}
+
+// PublicKeyCredentialRequestOptions for navigator.credentials.get()
+type PasskeyRequestOptions struct {
+	Challenge        string                  `json:"challenge"`
+	RPID             string                  `json:"rpId"`
+	Timeout          int64                   `json:"timeout"`
+	UserVerification string                  `json:"userVerification"`
+	AllowCredentials []PasskeyCredentialDesc `json:"allowCredentials"`
+}
+
+type PasskeyRelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type PasskeyUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type PasskeyCredentialParam struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type PasskeyCredentialDesc struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type PasskeyAuthenticatorSelect struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
 func CoreToResponse(data *user.Core) UserResponse {
 	var result = UserResponse{
-		ID:    data.ID,
-		Name:  data.Name,
-		Email: data.Email,
+		ID:           data.ID,
+		Name:         data.Name,
+		Email:        data.Email,
 		PhotoProfile: data.PhotoProfile,
 	}
 	return result
 }
+
+func TokenToResponse(token *user.TokenCore, name string) TokenResponse {
+	return TokenResponse{
+		Token:        token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		ExpiresIn:    token.ExpiresIn,
+		Name:         name,
+	}
+}
+
+func TokenToMfaResponse(token *user.TokenCore) MfaResponse {
+	return MfaResponse{
+		MfaToken:  token.MfaToken,
+		MfaMethod: token.MfaMethod,
+		ExpiresIn: token.ExpiresIn,
+	}
+}
+
+func CoreToSessionResponse(data user.SessionCore, currentSessionId uint) SessionResponse {
+	return SessionResponse{
+		ID:          data.ID,
+		UserAgent:   data.UserAgent,
+		IPAddress:   data.IPAddress,
+		LoginMethod: data.LoginMethod,
+		CreatedAt:   data.CreatedAt,
+		LastSeenAt:  data.LastSeenAt,
+		Current:     data.ID == currentSessionId,
+	}
+}
+
+func CoreToPasskeyResponse(data user.PasskeyCore) PasskeyResponse {
+	return PasskeyResponse{
+		ID:         data.ID,
+		Name:       data.Name,
+		CreatedAt:  data.CreatedAt,
+		LastUsedAt: data.LastUsedAt,
+	}
+}
+
+func CoreToIdentityResponse(data user.IdentityCore) IdentityResponse {
+	return IdentityResponse{
+		ID:       data.ID,
+		Provider: data.Provider,
+		Email:    data.Email,
+		LinkedAt: data.LinkedAt,
+	}
+}
+
+// LinkRequiredToResponse lists the ways the owner can prove ownership, a code always works
+func LinkRequiredToResponse(err *user.LinkRequiredError) LinkRequiredResponse {
+	methods := []string{"code"}
+	if err.HasPassword {
+		methods = []string{"password", "code"}
+	}
+	return LinkRequiredResponse{
+		LinkToken: err.LinkToken,
+		Provider:  err.Provider,
+		Email:     err.Email,
+		Methods:   methods,
+	}
+}
+
+func credentialDescriptors(credentialIds []string) []PasskeyCredentialDesc {
+	result := []PasskeyCredentialDesc{}
+	for _, v := range credentialIds {
+		result = append(result, PasskeyCredentialDesc{Type: "public-key", ID: v})
+	}
+	return result
+}
+
+func CoreToPasskeyCreationResponse(data *user.PasskeyOptionsCore) PasskeyOptionsResponse {
+	var params []PasskeyCredentialParam
+	for _, v := range data.Algorithms {
+		params = append(params, PasskeyCredentialParam{Type: "public-key", Alg: v})
+	}
+
+	return PasskeyOptionsResponse{
+		ChallengeID: data.ChallengeID,
+		PublicKey: PasskeyCreationOptions{
+			Challenge: data.Challenge,
+			RP:        PasskeyRelyingParty{ID: data.RPID, Name: data.RPName},
+			User: PasskeyUser{
+				ID:          data.UserHandle,
+				Name:        data.UserName,
+				DisplayName: data.UserDisplayName,
+			},
+			PubKeyCredParams:   params,
+			Timeout:            data.Timeout.Milliseconds(),
+			Attestation:        "none",
+			ExcludeCredentials: credentialDescriptors(data.CredentialIDs),
+			AuthenticatorSelection: PasskeyAuthenticatorSelect{
+				ResidentKey:      "required",
+				UserVerification: "required",
+			},
+		},
+	}
+}
+
+func CoreToPasskeyRequestResponse(data *user.PasskeyOptionsCore) PasskeyOptionsResponse {
+	return PasskeyOptionsResponse{
+		ChallengeID: data.ChallengeID,
+		PublicKey: PasskeyRequestOptions{
+			Challenge:        data.Challenge,
+			RPID:             data.RPID,
+			Timeout:          data.Timeout.Milliseconds(),
+			UserVerification: "required",
+			AllowCredentials: credentialDescriptors(data.CredentialIDs),
+		},
+	}
+}
+
+func BlockedToResponse(err *user.LoginBlockedError) LoginBlockedResponse {
+	return LoginBlockedResponse{
+		RetryAt:    err.RetryAt,
+		RetryAfter: int(math.Ceil(time.Until(err.RetryAt).Seconds())),
+	}
+}
@@ -1,30 +1,66 @@
 package service
 
 import (
+	"crypto/rand"
+	"emailnotifl3n/app/config"
 	"emailnotifl3n/features/user"
+	"emailnotifl3n/utils/breach"
+	"emailnotifl3n/utils/email"
 	"emailnotifl3n/utils/encrypts"
 	"emailnotifl3n/utils/middlewares"
+	"emailnotifl3n/utils/passwordpolicy"
+	"emailnotifl3n/utils/totp"
+	"emailnotifl3n/utils/webauthn"
+	"encoding/base64"
 	"errors"
 	"fmt"
-	"sync"
+	"log"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
 )
 
+const (
+	// refresh tokens stay valid for 30 days and are rotated on every use
+	refreshTokenExpiration  = 30 * 24 * time.Hour
+	resetPasswordExpiration = 15 * time.Minute
+	verifyEmailExpiration   = 24 * time.Hour
+	mfaPendingExpiration    = 5 * time.Minute
+	magicLinkExpiration     = 15 * time.Minute
+	unlockAccountExpiration = 24 * time.Hour
+	lockAccountExpiration   = 7 * 24 * time.Hour
+	emailChangeExpiration   = 24 * time.Hour
+	pendingLinkExpiration   = 15 * time.Minute
+	totpIssuer              = "emailnotifl3n"
+	recoveryCodeCount       = 10
+)
+
 type userService struct {
-	userData    user.UserDataInterface
-	hashService encrypts.HashInterface
-	validate    *validator.Validate
-	m           sync.Map
+	userData     user.UserDataInterface
+	hashService  encrypts.HashInterface
+	emailService email.EmailInterface
+	webauthn     webauthn.WebAuthnInterface
+	policy       passwordpolicy.PolicyInterface
+	breach       breach.BreachInterface
+	cfg          *config.AppConfig
+	validate     *validator.Validate
 }
 
 // dependency injection
-func New(repo user.UserDataInterface, hash encrypts.HashInterface) user.UserServiceInterface {
+func New(repo user.UserDataInterface, hash encrypts.HashInterface, email email.EmailInterface, webauthn webauthn.WebAuthnInterface, policy passwordpolicy.PolicyInterface, breach breach.BreachInterface, cfg *config.AppConfig) user.UserServiceInterface {
 	return &userService{
-		userData:    repo,
-		hashService: hash,
-		validate:    validator.New(),
+		userData:     repo,
+		hashService:  hash,
+		emailService: email,
+		webauthn:     webauthn,
+		policy:       policy,
+		breach:       breach,
+		cfg:          cfg,
+		validate:     validator.New(),
 	}
 }
 
@@ -36,6 +72,11 @@ func (service *userService) Create(input user.Core) error {
 	}
 
 	if input.Password != "" {
+		err := service.validateNewPassword(&input, input.Password)
+		if err != nil {
+			return err
+		}
+
 		hashedPass, errHash := service.hashService.HashPassword(input.Password)
 		if errHash != nil {
 			return errors.New("error hash password")
@@ -77,177 +118,1689 @@ func (service *userService) Delete(userId int) error {
 }
 
 // Login implements user.UserServiceInterface.
-func (service *userService) Login(email string, password string) (data *user.Core, token string, err error) {
+func (service *userService) Login(email string, password string, session user.SessionCore) (data *user.Core, token *user.TokenCore, err error) {
 	if email == "" && password == "" {
-		return nil, "", errors.New("email dan password wajib diisi")
+		return nil, nil, errors.New("email dan password wajib diisi")
 	}
 	if email == "" {
-		return nil, "", errors.New("email wajib diisi")
+		return nil, nil, errors.New("email wajib diisi")
 	}
 	if password == "" {
-		return nil, "", errors.New("password wajib diisi")
+		return nil, nil, errors.New("password wajib diisi")
+	}
+
+	accountKey := "account:" + strings.ToLower(email)
+	ipKey := "ip:" + session.IPAddress
+	err = service.checkLoginBlock(accountKey, ipKey)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	data, err = service.userData.Login(email, password)
 	if err != nil {
-		return nil, "", err
+		if errFailure := service.recordLoginFailure(nil, accountKey, ipKey); errFailure != nil {
+			return nil, nil, errFailure
+		}
+		return nil, nil, err
 	}
 
 	isValid := service.hashService.CheckPasswordHash(data.Password, password)
 	if !isValid {
-		return nil, "", errors.New("password tidak sesuai")
+		if errFailure := service.recordLoginFailure(data, accountKey, ipKey); errFailure != nil {
+			return nil, nil, errFailure
+		}
+		return nil, nil, errors.New("password tidak sesuai")
 	}
 
-	token, errJwt := middlewares.CreateTokenLogin(int(data.ID))
-	if errJwt != nil {
-		return nil, "", errJwt
+	err = service.userData.ResetLoginFailures(accountKey)
+	if err != nil {
+		return nil, nil, err
 	}
-	return data, token, err
-}
 
-// ChangePassword implements user.UserServiceInterface.
-func (service *userService) ChangePassword(userId int, oldPassword, newPassword string) error {
-	if oldPassword == "" {
-		return errors.New("please input current password")
+	// migrate hashes of older algorithms or costs while the plain password is at hand
+	if service.hashService.NeedsRehash(data.Password) {
+		service.rehashPassword(data, password)
 	}
 
-	if newPassword == "" {
-		return errors.New("please input new password")
+	if data.TotpEnabled || data.EmailOtpEnabled {
+		token, err = service.startSecondFactor(data, user.LoginMethodEmail)
+		if err != nil {
+			return nil, nil, err
+		}
+		return data, token, nil
 	}
 
-	hashedNewPass, errHash := service.hashService.HashPassword(newPassword)
-	if errHash != nil {
-		return errors.New("error hash password")
+	session.UserID = data.ID
+	session.LoginMethod = user.LoginMethodEmail
+	token, err = service.createSession(session)
+	if err != nil {
+		return nil, nil, err
 	}
+	return data, token, nil
+}
 
-	err := service.userData.ChangePassword(userId, oldPassword, hashedNewPass)
-	return err
+// rehashPassword is best effort, a failure must not stop the login
+func (service *userService) rehashPassword(data *user.Core, password string) {
+	hashed, err := service.hashService.HashPassword(password)
+	if err != nil {
+		return
+	}
+	err = service.userData.UpdatePasswordHash(int(data.ID), hashed)
+	if err != nil {
+		log.Println("error rehash password:", err.Error())
+		return
+	}
+	data.Password = hashed
+}
 
+// checkLoginBlock returns a *user.LoginBlockedError while any of the keys is blocked
+func (service *userService) checkLoginBlock(keys ...string) error {
+	for _, key := range keys {
+		until, err := service.userData.SelectLoginBlock(key)
+		if err != nil {
+			return err
+		}
+		if time.Now().Before(until) {
+			return &user.LoginBlockedError{RetryAt: until}
+		}
+	}
+	return nil
 }
 
-// ForgotPassword implements user.UserServiceInterface.
-func (service *userService) ForgotPassword(email string) (data *user.Core, token string, err error) {
-	user, err := service.userData.SelectByEmail(email)
+// recordLoginFailure counts a failed login. Every failure delays the next attempt
+// on the account twice as long as the one before, reaching the threshold locks it
+// and mails the owner an unlock link. data is nil when the email is unknown.
+func (service *userService) recordLoginFailure(data *user.Core, accountKey, ipKey string) error {
+	now := time.Now()
+	lockedUntil := now.Add(service.cfg.LOCKOUT_DURATION)
+
+	ipFailures, err := service.userData.IncrementLoginFailures(ipKey, service.cfg.LOCKOUT_DURATION)
 	if err != nil {
-		return nil, "", err
+		return err
+	}
+	if ipFailures >= service.cfg.LOCKOUT_IP_THRESHOLD {
+		err = service.userData.BlockLogin(ipKey, lockedUntil)
+		if err != nil {
+			return err
+		}
 	}
 
-	token, err = middlewares.CreateResetPasswordToken(int(user.ID))
+	failures, err := service.userData.IncrementLoginFailures(accountKey, service.cfg.LOCKOUT_DURATION)
 	if err != nil {
-		return nil, "", err
+		return err
 	}
+	if failures >= service.cfg.LOCKOUT_THRESHOLD {
+		err = service.userData.BlockLogin(accountKey, lockedUntil)
+		if err != nil {
+			return err
+		}
 
-	return user, token, nil
+		// only the failure that locks the account sends a mail
+		if failures == service.cfg.LOCKOUT_THRESHOLD && data != nil {
+			token, err := service.createActionToken(int(data.ID), middlewares.PurposeUnlockAccount, unlockAccountExpiration)
+			if err != nil {
+				return err
+			}
+			err = service.emailService.SendAccountLocked(data, token)
+			if err != nil {
+				return err
+			}
+		}
+		return &user.LoginBlockedError{RetryAt: lockedUntil}
+	}
+
+	delay := service.cfg.LOCKOUT_DELAY
+	for i := 1; i < failures && delay < service.cfg.LOCKOUT_DURATION; i++ {
+		delay *= 2
+	}
+	if delay > service.cfg.LOCKOUT_DURATION {
+		delay = service.cfg.LOCKOUT_DURATION
+	}
+	if delay <= 0 {
+		return nil
+	}
+	return service.userData.BlockLogin(accountKey, now.Add(delay))
 }
 
-// ResetPassword implements user.UserServiceInterface.
-func (service *userService) ResetPassword(userId int, newPassword string) error {
-	hashedNewPass, errHash := service.hashService.HashPassword(newPassword)
-	if errHash != nil {
-		return errors.New("error hash password")
+// UnlockAccount implements user.UserServiceInterface.
+func (service *userService) UnlockAccount(token string) error {
+	userId, err := service.useActionToken(token, middlewares.PurposeUnlockAccount)
+	if err != nil {
+		return err
 	}
 
-	err := service.userData.ResetPasswordLink(userId, hashedNewPass)
+	data, err := service.userData.SelectById(userId)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	err = service.userData.ResetLoginFailures("account:" + strings.ToLower(data.Email))
+	return err
 }
 
-// VerifyEmailLink implements user.UserServiceInterface.
-func (service *userService) VerifyEmailLink(userId int) error {
-	verification := true
+// LockAccount implements user.UserServiceInterface.
+// It backs the "this wasn't me" link of the password changed email.
+func (service *userService) LockAccount(token string) error {
+	userId, err := service.useActionToken(token, middlewares.PurposeLockAccount)
+	if err != nil {
+		return err
+	}
 
-	err := service.userData.VerifyEmailLink(userId, verification)
+	err = service.userData.LockAccount(userId)
 	if err != nil {
 		return err
 	}
-	return nil
+	return service.userData.RevokeOtherSessions(userId, 0)
 }
 
-// RequestCode implements user.UserServiceInterface.
-func (service *userService) RequestCode(email string, code string) (data *user.Core, err error) {
+// RequestMagicLink implements user.UserServiceInterface.
+func (service *userService) RequestMagicLink(email string) (data *user.Core, token string, err error) {
 	if email == "" {
-		return nil, errors.New("email harus di isi")
+		return nil, "", errors.New("email wajib diisi")
 	}
 
-	mail, err := service.userData.SelectByEmail(email)
+	data, err = service.userData.SelectByEmail(email)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	token, err = service.createActionToken(int(data.ID), middlewares.PurposeMagicLogin, magicLinkExpiration)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, token, nil
+}
+
+// LoginMagicLink implements user.UserServiceInterface.
+func (service *userService) LoginMagicLink(token string, session user.SessionCore) (data *user.Core, result *user.TokenCore, err error) {
+	userId, err := service.useActionToken(token, middlewares.PurposeMagicLogin)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err = service.userData.SelectById(userId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// opening the link proves ownership of the address
+	if !data.Verified {
+		err = service.userData.VerifyEmailLink(userId, true)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if data.TotpEnabled || data.EmailOtpEnabled {
+		result, err = service.startSecondFactor(data, user.LoginMethodMagicLink)
+		if err != nil {
+			return nil, nil, err
+		}
+		return data, result, nil
+	}
+
+	session.UserID = data.ID
+	session.LoginMethod = user.LoginMethodMagicLink
+	result, err = service.createSession(session)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, result, nil
+}
+
+// LoginSecondFactor implements user.UserServiceInterface.
+func (service *userService) LoginSecondFactor(mfaToken, code string, session user.SessionCore) (data *user.Core, token *user.TokenCore, err error) {
+	if code == "" {
+		return nil, nil, errors.New("kode 2FA wajib diisi")
+	}
+
+	userId, nonce, err := middlewares.ExtractActionToken(mfaToken, middlewares.PurposeMfaPending)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = service.checkActionNonce(middlewares.PurposeMfaPending, nonce, userId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// wrong codes are counted per pending login, the token is burned
+	// once they are used up and the password has to be entered again
+	attempts, err := service.userData.CountActionNonceAttempt(middlewares.PurposeMfaPending, nonce, mfaPendingExpiration)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	isValid, _ := service.userData.CheckCode(email)
-	if isValid {
-		if creationTime, ok := service.m.Load(email); ok {
-			elapsed := time.Since(creationTime.(time.Time))
-			if elapsed < 1*time.Minute {
-				remaining := 1*time.Minute - elapsed
-				return nil, fmt.Errorf("coba lagi minta kode dalam %.0f detik", remaining.Seconds())
-			} else {
-				err := service.userData.DeleteCode(email)
-				if err != nil {
-					return nil, err
-				}
-				isValid = false
+	data, err = service.userData.SelectById(userId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = service.verifySecondFactor(data, code)
+	if err != nil {
+		if attempts >= service.cfg.CODE_MAX_ATTEMPTS {
+			if errBurn := service.userData.BurnActionNonce(middlewares.PurposeMfaPending, nonce); errBurn != nil {
+				return nil, nil, errBurn
 			}
+			return nil, nil, errors.New("terlalu banyak percobaan, silakan login ulang")
 		}
+		return nil, nil, err
+	}
+
+	// the pending token is only consumed once the second factor is correct
+	storedUserId, err := service.userData.ConsumeActionNonce(middlewares.PurposeMfaPending, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	if storedUserId != userId {
+		return nil, nil, errors.New("token tidak valid")
+	}
+
+	loginMethod, err := service.userData.ConsumeMfaLoginMethod(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session.UserID = data.ID
+	session.LoginMethod = loginMethod
+	token, err = service.createSession(session)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, token, nil
+}
+
+// SetupTotp implements user.UserServiceInterface.
+func (service *userService) SetupTotp(userId int) (secret string, uri string, err error) {
+	data, err := service.userData.SelectById(userId)
+	if err != nil {
+		return "", "", err
+	}
+	if data.TotpEnabled {
+		return "", "", errors.New("2FA sudah aktif")
+	}
+
+	secret, err = totp.GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+
+	err = service.userData.UpdateTotp(userId, secret, false)
+	if err != nil {
+		return "", "", err
+	}
+
+	return secret, totp.URI(totpIssuer, data.Email, secret), nil
+}
+
+// ConfirmTotp implements user.UserServiceInterface.
+func (service *userService) ConfirmTotp(userId int, code string) (recoveryCodes []string, err error) {
+	data, err := service.userData.SelectById(userId)
+	if err != nil {
+		return nil, err
+	}
+	if data.TotpEnabled {
+		return nil, errors.New("2FA sudah aktif")
 	}
+	if data.TotpSecret == "" {
+		return nil, errors.New("silakan setup 2FA terlebih dahulu")
+	}
+
+	step, isValid := totp.Validate(data.TotpSecret, code, time.Now())
 	if !isValid {
-		err = service.userData.CreateCode(email, code)
+		return nil, errors.New("kode 2FA salah")
+	}
+	_, err = service.userData.MarkTotpStepUsed(userId, step)
+	if err != nil {
+		return nil, err
+	}
+
+	var codeHashes []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
 		if err != nil {
 			return nil, err
 		}
-		service.m.Store(email, time.Now())
+
+		hashed, errHash := service.hashService.HashPassword(code)
+		if errHash != nil {
+			return nil, errors.New("error hash recovery code")
+		}
+		recoveryCodes = append(recoveryCodes, code)
+		codeHashes = append(codeHashes, hashed)
+	}
+
+	err = service.userData.ReplaceRecoveryCodes(userId, codeHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = service.userData.UpdateTotp(userId, data.TotpSecret, true)
+	if err != nil {
+		return nil, err
 	}
-	return mail, nil
+	return recoveryCodes, nil
 }
 
-// ResetPasswordCode implements user.UserServiceInterface.
-func (service *userService) ResetPasswordCode(email, newPassword, code string) error {
-	err := service.userData.VerifyCode(email, code)
+// SetEmailOtp implements user.UserServiceInterface.
+func (service *userService) SetEmailOtp(userId int, enabled bool) error {
+	data, err := service.userData.SelectById(userId)
 	if err != nil {
 		return err
 	}
+	if enabled && !data.Verified {
+		return errors.New("verifikasi email terlebih dahulu")
+	}
+
+	return service.userData.UpdateEmailOtp(userId, enabled)
+}
+
+// verifySecondFactor checks code against the factor chosen by startSecondFactor
+func (service *userService) verifySecondFactor(data *user.Core, code string) error {
+	switch {
+	case data.TotpEnabled:
+		return service.verifyTotp(data, code)
+	case data.EmailOtpEnabled:
+		return service.userData.VerifyCode(user.CodePurposeLogin, data.Email, code)
+	}
+	return errors.New("2FA tidak aktif")
+}
+
+// verifyTotp accepts a TOTP code or one of the unused recovery codes
+func (service *userService) verifyTotp(data *user.Core, code string) error {
+	if len(code) == totp.Digits {
+		step, isValid := totp.Validate(data.TotpSecret, code, time.Now())
+		if !isValid {
+			return errors.New("kode 2FA salah")
+		}
+
+		fresh, err := service.userData.MarkTotpStepUsed(int(data.ID), step)
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return errors.New("kode 2FA sudah digunakan")
+		}
+		return nil
+	}
 
-	err = service.userData.ResetPasswordCode(email, newPassword)
+	codes, err := service.userData.SelectRecoveryCodes(int(data.ID))
 	if err != nil {
 		return err
 	}
 
-	return nil
+	code = normalizeRecoveryCode(code)
+	for _, v := range codes {
+		if service.hashService.CheckPasswordHash(v.CodeHash, code) {
+			return service.userData.UseRecoveryCode(v.ID)
+		}
+	}
+	return errors.New("kode 2FA salah")
 }
 
-// VerifyEmailCode implements user.UserServiceInterface.
-func (service *userService) VerifyEmailCode(email, code string) error {
-	err := service.userData.VerifyCode(email, code)
+// startSecondFactor issues the short-lived token exchanged at /login/2fa.
+// TOTP wins when enrolled, otherwise a code is sent by email. loginMethod is
+// the first factor, the session created after the second one records it.
+func (service *userService) startSecondFactor(data *user.Core, loginMethod string) (*user.TokenCore, error) {
+	if data.LockedAt != nil {
+		return nil, user.ErrAccountLocked
+	}
+
+	method := user.MfaMethodTotp
+	if !data.TotpEnabled {
+		method = user.MfaMethodEmail
+
+		code, err := generateCode()
+		if err != nil {
+			return nil, err
+		}
+
+		err = service.userData.CreateCode(user.CodePurposeLogin, data.Email, code)
+		if err != nil {
+			return nil, err
+		}
+
+		err = service.emailService.SendLoginCode(data, code)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mfaToken, nonce, err := service.createActionTokenNonce(int(data.ID), middlewares.PurposeMfaPending, mfaPendingExpiration)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	verification := true
+	err = service.userData.CreateMfaLoginMethod(nonce, loginMethod, mfaPendingExpiration)
+	if err != nil {
+		return nil, err
+	}
 
-	err = service.userData.VerifyEmailCode(email, verification)
+	return &user.TokenCore{
+		MfaToken:  mfaToken,
+		MfaMethod: method,
+		ExpiresIn: int64(mfaPendingExpiration.Seconds()),
+	}, nil
+}
+
+// generateCode returns a random 6 digit code
+func generateCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(900000))
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	return fmt.Sprintf("%06d", n.Int64()+100000), nil
 }
 
-// SelectByEmail implements user.UserServiceInterface.
-func (service *userService) SelectByEmail(email string) (*user.Core, error) {
-	user, err := service.userData.SelectByEmail(email)
+// generateRecoveryCode returns a code formatted as xxxxx-xxxxx
+func generateRecoveryCode() (string, error) {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz234567"
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b[:5]) + "-" + string(b[5:]), nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) == 10 {
+		code = code[:5] + "-" + code[5:]
+	}
+	return code
+}
+
+// BeginPasskeyRegistration implements user.UserServiceInterface.
+func (service *userService) BeginPasskeyRegistration(userId int) (*user.PasskeyOptionsCore, error) {
+	data, err := service.userData.SelectById(userId)
 	if err != nil {
 		return nil, err
 	}
-	return user, nil
+
+	passkeys, err := service.userData.SelectPasskeysByUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := service.webauthn.NewChallenge()
+	if err != nil {
+		return nil, err
+	}
+
+	// one registration at a time per user, a new begin replaces the old challenge
+	challengeId := "register:" + strconv.Itoa(userId)
+	err = service.userData.CreateWebauthnChallenge(challengeId, challenge, webauthn.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	rp := service.webauthn.RelyingParty()
+	result := &user.PasskeyOptionsCore{
+		Challenge:       challenge,
+		RPID:            rp.ID,
+		RPName:          rp.Name,
+		UserHandle:      base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(userId))),
+		UserName:        data.Email,
+		UserDisplayName: data.Name,
+		Algorithms:      webauthn.SupportedAlgorithms,
+		Timeout:         webauthn.Timeout,
+	}
+	for _, v := range passkeys {
+		result.CredentialIDs = append(result.CredentialIDs, v.CredentialID)
+	}
+	return result, nil
 }
 
-// RegisterGoogle implements user.UserServiceInterface.
-func (service *userService) RegisterGoogle(input user.Core) error {
-	err := service.userData.Insert(input)
+// FinishPasskeyRegistration implements user.UserServiceInterface.
+func (service *userService) FinishPasskeyRegistration(userId int, input user.PasskeyCredentialCore) error {
+	challenge, err := service.userData.ConsumeWebauthnChallenge("register:" + strconv.Itoa(userId))
+	if err != nil {
+		return err
+	}
+
+	credential, err := service.webauthn.VerifyRegistration(challenge, input.ClientDataJSON, input.AttestationObject)
 	if err != nil {
 		return err
 	}
 
+	name := input.Name
+	if name == "" {
+		name = "Passkey"
+	}
+
+	err = service.userData.InsertPasskey(user.PasskeyCore{
+		UserID:       uint(userId),
+		CredentialID: base64.RawURLEncoding.EncodeToString(credential.ID),
+		PublicKey:    credential.PublicKey,
+		SignCount:    credential.SignCount,
+		Name:         name,
+	})
+	return err
+}
+
+// BeginPasskeyLogin implements user.UserServiceInterface.
+// The options are the same for everyone, the browser offers the discoverable
+// passkeys of this site, so nothing tells whether an account exists.
+func (service *userService) BeginPasskeyLogin() (*user.PasskeyOptionsCore, error) {
+	challenge, err := service.webauthn.NewChallenge()
+	if err != nil {
+		return nil, err
+	}
+
+	challengeId, err := encrypts.GenerateRandomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	err = service.userData.CreateWebauthnChallenge("login:"+challengeId, challenge, webauthn.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user.PasskeyOptionsCore{
+		ChallengeID:   challengeId,
+		Challenge:     challenge,
+		RPID:          service.webauthn.RelyingParty().ID,
+		Timeout:       webauthn.Timeout,
+	}, nil
+}
+
+// FinishPasskeyLogin implements user.UserServiceInterface.
+// A passkey already combines possession and user verification, so no second factor is asked.
+func (service *userService) FinishPasskeyLogin(input user.PasskeyCredentialCore, session user.SessionCore) (data *user.Core, token *user.TokenCore, err error) {
+	if input.ChallengeID == "" || input.CredentialID == "" {
+		return nil, nil, errors.New("challenge_id dan id wajib diisi")
+	}
+
+	challenge, err := service.userData.ConsumeWebauthnChallenge("login:" + input.ChallengeID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	passkey, err := service.userData.SelectPasskeyByCredentialId(input.CredentialID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// discoverable credentials report the user handle given at registration
+	if len(input.UserHandle) > 0 && string(input.UserHandle) != strconv.Itoa(int(passkey.UserID)) {
+		return nil, nil, errors.New("passkey tidak sesuai")
+	}
+
+	signCount, err := service.webauthn.VerifyAssertion(challenge, webauthn.Credential{
+		PublicKey: passkey.PublicKey,
+		SignCount: passkey.SignCount,
+	}, input.ClientDataJSON, input.AuthenticatorData, input.Signature)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = service.userData.UpdatePasskeyUsage(passkey.ID, signCount)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err = service.userData.SelectById(int(passkey.UserID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session.UserID = data.ID
+	session.LoginMethod = user.LoginMethodPasskey
+	token, err = service.createSession(session)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, token, nil
+}
+
+// GetPasskeys implements user.UserServiceInterface.
+func (service *userService) GetPasskeys(userId int) ([]user.PasskeyCore, error) {
+	result, err := service.userData.SelectPasskeysByUser(userId)
+	return result, err
+}
+
+// DeletePasskey implements user.UserServiceInterface.
+func (service *userService) DeletePasskey(userId int, passkeyId uint) error {
+	if passkeyId == 0 {
+		return errors.New("invalid id")
+	}
+
+	passkeys, err := service.userData.SelectPasskeysByUser(userId)
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(passkeys, func(v user.PasskeyCore) bool { return v.ID == passkeyId }) {
+		return errors.New("error record not found")
+	}
+
+	err = service.checkOtherLoginMethod(userId)
+	if err != nil {
+		return err
+	}
+	return service.userData.DeletePasskey(userId, passkeyId)
+}
+
+// RefreshToken implements user.UserServiceInterface.
+func (service *userService) RefreshToken(refreshToken string) (*user.TokenCore, error) {
+	if refreshToken == "" {
+		return nil, errors.New("refresh token wajib diisi")
+	}
+
+	stored, err := service.userData.SelectRefreshToken(encrypts.HashToken(refreshToken))
+	if err != nil {
+		return nil, err
+	}
+
+	if stored.RevokedAt != nil {
+		return nil, errors.New("refresh token tidak valid")
+	}
+
+	// a rotated token presented again means it was stolen, end the whole session
+	if stored.UsedAt != nil {
+		errRevoke := service.userData.RevokeSession(stored.SessionID)
+		if errRevoke != nil {
+			return nil, errRevoke
+		}
+		return nil, errors.New("refresh token sudah digunakan, silakan login kembali")
+	}
+
+	if time.Now().After(stored.ExpiresAt) {
+		return nil, errors.New("refresh token kedaluwarsa")
+	}
+
+	err = service.userData.UseRefreshToken(stored.ID)
+	if err != nil {
+		errRevoke := service.userData.RevokeSession(stored.SessionID)
+		if errRevoke != nil {
+			return nil, errRevoke
+		}
+		return nil, err
+	}
+
+	err = service.userData.TouchSession(stored.SessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return service.createToken(stored.UserID, stored.SessionID)
+}
+
+// Logout implements user.UserServiceInterface.
+func (service *userService) Logout(userId int, sessionId uint, jti string, expiresAt time.Time) error {
+	if jti == "" {
+		return errors.New("token tidak valid")
+	}
+
+	remaining := time.Until(expiresAt)
+	if remaining > 0 {
+		err := service.userData.RevokeToken(jti, remaining)
+		if err != nil {
+			return err
+		}
+	}
+
+	return service.EndSession(userId, sessionId)
+}
+
+// GetSessions implements user.UserServiceInterface.
+func (service *userService) GetSessions(userId int) ([]user.SessionCore, error) {
+	if userId <= 0 {
+		return nil, errors.New("invalid id")
+	}
+	return service.userData.SelectSessionsByUser(userId)
+}
+
+// EndSession implements user.UserServiceInterface.
+func (service *userService) EndSession(userId int, sessionId uint) error {
+	session, err := service.userData.SelectSessionById(sessionId)
+	if err != nil {
+		return err
+	}
+	if session.UserID != uint(userId) {
+		return errors.New("session tidak ditemukan")
+	}
+
+	return service.userData.RevokeSession(sessionId)
+}
+
+// EndOtherSessions implements user.UserServiceInterface.
+func (service *userService) EndOtherSessions(userId int, currentSessionId uint) error {
+	if userId <= 0 {
+		return errors.New("invalid id")
+	}
+	return service.userData.RevokeOtherSessions(userId, currentSessionId)
+}
+
+// createSession records a new login and issues its first token pair
+func (service *userService) createSession(session user.SessionCore) (*user.TokenCore, error) {
+	data, err := service.userData.SelectById(int(session.UserID))
+	if err != nil {
+		return nil, err
+	}
+	if data.LockedAt != nil {
+		return nil, user.ErrAccountLocked
+	}
+
+	session.LastSeenAt = time.Now()
+	sessionId, err := service.userData.InsertSession(session)
+	if err != nil {
+		return nil, err
+	}
+
+	return service.createToken(session.UserID, sessionId)
+}
+
+// createToken issues an access token and a refresh token bound to the session
+func (service *userService) createToken(userId uint, sessionId uint) (*user.TokenCore, error) {
+	tokenVersion, err := service.userData.SelectTokenVersion(int(userId))
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := middlewares.CreateTokenLogin(int(userId), sessionId, tokenVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := encrypts.GenerateRandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	err = service.userData.InsertRefreshToken(user.RefreshTokenCore{
+		UserID:    userId,
+		SessionID: sessionId,
+		TokenHash: encrypts.HashToken(refreshToken),
+		ExpiresAt: time.Now().Add(refreshTokenExpiration),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &user.TokenCore{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(middlewares.AccessTokenExpiration.Seconds()),
+	}, nil
+}
+
+// ChangePassword implements user.UserServiceInterface.
+func (service *userService) ChangePassword(userId int, sessionId uint, oldPassword, newPassword string) error {
+	if oldPassword == "" {
+		return errors.New("please input current password")
+	}
+
+	if newPassword == "" {
+		return errors.New("please input new password")
+	}
+
+	data, err := service.userData.SelectById(userId)
+	if err != nil {
+		return err
+	}
+
+	// accounts created through oauth have no password to change
+	if data.Password == "" || !service.hashService.CheckPasswordHash(data.Password, oldPassword) {
+		return errors.New("password lama tidak sesuai")
+	}
+
+	if newPassword == oldPassword {
+		return errors.New("password baru harus berbeda dari password lama")
+	}
+
+	err = service.validateNewPassword(data, newPassword)
+	if err != nil {
+		return err
+	}
+
+	hashedNewPass, errHash := service.hashService.HashPassword(newPassword)
+	if errHash != nil {
+		return errors.New("error hash password")
+	}
+
+	err = service.userData.ChangePassword(userId, hashedNewPass)
+	if err != nil {
+		return err
+	}
+
+	// the current session survives and picks up the new token version on refresh
+	err = service.userData.RevokeOtherSessions(userId, sessionId)
+	if err != nil {
+		return err
+	}
+
+	service.notifyPasswordChanged(data)
+	return nil
+}
+
+// notifyPasswordChanged mails the owner a link to lock the account in case someone
+// else changed the password. The password is already changed, so failures are only logged.
+func (service *userService) notifyPasswordChanged(data *user.Core) {
+	token, err := service.createActionToken(int(data.ID), middlewares.PurposeLockAccount, lockAccountExpiration)
+	if err != nil {
+		log.Println("error create lock account token:", err.Error())
+		return
+	}
+
+	err = service.emailService.SendPasswordChanged(data, token)
+	if err != nil {
+		log.Println("error sending password changed email:", err.Error())
+	}
+}
+
+// validateNewPassword checks a password about to be set for data against the password policy
+// and the breach corpus, every failed check ends up in one *passwordpolicy.PolicyError
+func (service *userService) validateNewPassword(data *user.Core, password string) error {
+	err := service.policy.Validate(password, data.Email, data.Name)
+	var errPolicy *passwordpolicy.PolicyError
+	if err != nil && !errors.As(err, &errPolicy) {
+		return err
+	}
+
+	if service.breach.IsBreached(password) {
+		if errPolicy == nil {
+			errPolicy = &passwordpolicy.PolicyError{}
+		}
+		errPolicy.Add(passwordpolicy.RuleBreached, "password ini pernah bocor dalam kebocoran data, pilih password lain")
+	}
+
+	reused, err := service.isRecentPassword(data, password)
+	if err != nil {
+		return err
+	}
+	if reused {
+		if errPolicy == nil {
+			errPolicy = &passwordpolicy.PolicyError{}
+		}
+		errPolicy.Add(passwordpolicy.RuleReused, fmt.Sprintf("password tidak boleh sama dengan %d password terakhir", service.cfg.PASSWORD_HISTORY))
+	}
+
+	if errPolicy != nil {
+		return errPolicy
+	}
+	return nil
+}
+
+// isRecentPassword reports whether password matches the current password
+// or one of the replaced ones kept in the password history
+func (service *userService) isRecentPassword(data *user.Core, password string) (bool, error) {
+	if data.ID == 0 || service.cfg.PASSWORD_HISTORY <= 0 {
+		return false, nil
+	}
+
+	hashes, err := service.userData.SelectPasswordHistory(int(data.ID), service.cfg.PASSWORD_HISTORY-1)
+	if err != nil {
+		return false, err
+	}
+	if data.Password != "" {
+		hashes = append([]string{data.Password}, hashes...)
+	}
+
+	for _, hashed := range hashes {
+		if service.hashService.CheckPasswordHash(hashed, password) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ForgotPassword implements user.UserServiceInterface.
+func (service *userService) ForgotPassword(email string) (data *user.Core, token string, err error) {
+	user, err := service.userData.SelectByEmail(email)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token, err = service.createActionToken(int(user.ID), middlewares.PurposeResetPassword, resetPasswordExpiration)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return user, token, nil
+}
+
+// ResetPassword implements user.UserServiceInterface.
+func (service *userService) ResetPassword(token, newPassword string) error {
+	if newPassword == "" {
+		return errors.New("please input new password")
+	}
+
+	userId, nonce, err := middlewares.ExtractActionToken(token, middlewares.PurposeResetPassword)
+	if err != nil {
+		return err
+	}
+
+	// a used or expired link is refused before the password is looked at
+	err = service.checkActionNonce(middlewares.PurposeResetPassword, nonce, userId)
+	if err != nil {
+		return err
+	}
+
+	data, err := service.userData.SelectById(userId)
+	if err != nil {
+		return err
+	}
+
+	// a rejected password leaves the link usable for another try
+	err = service.validateNewPassword(data, newPassword)
+	if err != nil {
+		return err
+	}
+
+	err = service.consumeActionNonce(middlewares.PurposeResetPassword, nonce, userId)
+	if err != nil {
+		return err
+	}
+
+	hashedNewPass, errHash := service.hashService.HashPassword(newPassword)
+	if errHash != nil {
+		return errors.New("error hash password")
+	}
+
+	err = service.userData.ResetPasswordLink(userId, hashedNewPass)
+	if err != nil {
+		return err
+	}
+
+	// session id 0 never exists, so every session is ended
+	return service.userData.RevokeOtherSessions(userId, 0)
+}
+
+// RequestVerifyEmail implements user.UserServiceInterface.
+func (service *userService) RequestVerifyEmail(email string) (data *user.Core, token string, err error) {
+	data, err = service.userData.SelectByEmail(email)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token, err = service.createActionToken(int(data.ID), middlewares.PurposeVerifyEmail, verifyEmailExpiration)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, token, nil
+}
+
+// VerifyEmailLink implements user.UserServiceInterface.
+func (service *userService) VerifyEmailLink(token string) error {
+	userId, err := service.useActionToken(token, middlewares.PurposeVerifyEmail)
+	if err != nil {
+		return err
+	}
+
+	verification := true
+
+	err = service.userData.VerifyEmailLink(userId, verification)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// createActionToken signs a single-use token for purpose and stores its nonce
+func (service *userService) createActionToken(userId int, purpose string, expiration time.Duration) (string, error) {
+	token, _, err := service.createActionTokenNonce(userId, purpose, expiration)
+	return token, err
+}
+
+// createActionTokenNonce is createActionToken for callers that bind the nonce to other state
+func (service *userService) createActionTokenNonce(userId int, purpose string, expiration time.Duration) (token string, nonce string, err error) {
+	nonce, err = encrypts.GenerateRandomToken(16)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = service.userData.CreateActionNonce(purpose, nonce, userId, expiration)
+	if err != nil {
+		return "", "", err
+	}
+
+	token, err = middlewares.CreateActionToken(userId, purpose, nonce, expiration)
+	if err != nil {
+		return "", "", err
+	}
+	return token, nonce, nil
+}
+
+// useActionToken validates a token for purpose and consumes its nonce
+func (service *userService) useActionToken(token, purpose string) (int, error) {
+	userId, nonce, err := middlewares.ExtractActionToken(token, purpose)
+	if err != nil {
+		return 0, err
+	}
+
+	err = service.consumeActionNonce(purpose, nonce, userId)
+	if err != nil {
+		return 0, err
+	}
+	return userId, nil
+}
+
+// checkActionNonce is consumeActionNonce without using the nonce up
+func (service *userService) checkActionNonce(purpose, nonce string, userId int) error {
+	storedUserId, err := service.userData.SelectActionNonce(purpose, nonce)
+	if err != nil {
+		return err
+	}
+	if storedUserId != userId {
+		return errors.New("token tidak valid")
+	}
+	return nil
+}
+
+func (service *userService) consumeActionNonce(purpose, nonce string, userId int) error {
+	storedUserId, err := service.userData.ConsumeActionNonce(purpose, nonce)
+	if err != nil {
+		return err
+	}
+	if storedUserId != userId {
+		return errors.New("token tidak valid")
+	}
+	return nil
+}
+
+// RequestEmailChange implements user.UserServiceInterface.
+// The email stays the same until the new address confirms with the link or the code,
+// the old address gets a link to cancel the request.
+func (service *userService) RequestEmailChange(userId int, newEmail, password string) (data *user.Core, change *user.EmailChangeCore, err error) {
+	errValidate := service.validate.Var(newEmail, "required,email")
+	if errValidate != nil {
+		return nil, nil, errors.New("email baru tidak valid")
+	}
+	if password == "" {
+		return nil, nil, errors.New("please input current password")
+	}
+
+	data, err = service.userData.SelectById(userId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// once swapped the old address can't cancel anymore, so an access token
+	// alone must not be enough to move the account to another address
+	if data.Password == "" {
+		return nil, nil, errors.New("akun belum memiliki password, atur password lewat lupa password terlebih dahulu")
+	}
+	if !service.hashService.CheckPasswordHash(data.Password, password) {
+		return nil, nil, errors.New("password tidak sesuai")
+	}
+	if strings.EqualFold(data.Email, newEmail) {
+		return nil, nil, errors.New("email baru sama dengan email sekarang")
+	}
+
+	err = service.checkEmailAvailable(newEmail)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	change = &user.EmailChangeCore{NewEmail: newEmail}
+	change.ConfirmToken, change.Nonce, err = service.createActionTokenNonce(userId, middlewares.PurposeChangeEmail, emailChangeExpiration)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	change.CancelToken, change.CancelNonce, err = service.createActionTokenNonce(userId, middlewares.PurposeCancelEmailChange, emailChangeExpiration)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	change.Code, err = generateCode()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = service.userData.CreateCode(user.CodePurposeChangeEmail, emailChangeCodeSubject(userId, newEmail), change.Code)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = service.userData.CreateEmailChange(userId, *change, emailChangeExpiration)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, change, nil
+}
+
+// ConfirmEmailChange implements user.UserServiceInterface.
+func (service *userService) ConfirmEmailChange(token string) error {
+	userId, nonce, err := middlewares.ExtractActionToken(token, middlewares.PurposeChangeEmail)
+	if err != nil {
+		return err
+	}
+
+	pending, err := service.userData.SelectEmailChange(userId)
+	if err != nil {
+		return err
+	}
+
+	// links of an earlier request must not confirm the address of a later one
+	if pending.Nonce != nonce {
+		return errors.New("token tidak valid")
+	}
+
+	err = service.consumeActionNonce(middlewares.PurposeChangeEmail, nonce, userId)
+	if err != nil {
+		return err
+	}
+
+	// the link may be opened on any device, so every session is ended
+	return service.swapEmail(userId, 0, pending)
+}
+
+// ConfirmEmailChangeCode implements user.UserServiceInterface.
+func (service *userService) ConfirmEmailChangeCode(userId int, sessionId uint, code string) error {
+	pending, err := service.userData.SelectEmailChange(userId)
+	if err != nil {
+		return err
+	}
+
+	err = service.userData.VerifyCode(user.CodePurposeChangeEmail, emailChangeCodeSubject(userId, pending.NewEmail), code)
+	if err != nil {
+		return err
+	}
+
+	return service.swapEmail(userId, sessionId, pending)
+}
+
+// CancelEmailChange implements user.UserServiceInterface.
+func (service *userService) CancelEmailChange(token string) error {
+	userId, nonce, err := middlewares.ExtractActionToken(token, middlewares.PurposeCancelEmailChange)
+	if err != nil {
+		return err
+	}
+
+	pending, err := service.userData.SelectEmailChange(userId)
+	if err != nil {
+		return err
+	}
+
+	// the notice of an earlier request must not cancel a later one
+	if pending.CancelNonce != nonce {
+		return errors.New("token tidak valid")
+	}
+
+	err = service.consumeActionNonce(middlewares.PurposeCancelEmailChange, nonce, userId)
+	if err != nil {
+		return err
+	}
+
+	err = service.userData.DeleteCode(user.CodePurposeChangeEmail, emailChangeCodeSubject(userId, pending.NewEmail))
+	if err != nil {
+		return err
+	}
+	return service.userData.DeleteEmailChange(userId)
+}
+
+// emailChangeCodeSubject keys the code of an email change by the user as well,
+// two users asking for the same new address don't replace each other's code
+func emailChangeCodeSubject(userId int, newEmail string) string {
+	return strconv.Itoa(userId) + ":" + newEmail
+}
+
+// swapEmail applies a confirmed email change and ends every session but exceptSessionId
+func (service *userService) swapEmail(userId int, exceptSessionId uint, pending *user.EmailChangeCore) error {
+	// the address may have been registered since the request
+	err := service.checkEmailAvailable(pending.NewEmail)
+	if err != nil {
+		return err
+	}
+
+	err = service.userData.ChangeEmail(userId, pending.NewEmail)
+	if err != nil {
+		return err
+	}
+
+	err = service.userData.DeleteEmailChange(userId)
+	if err != nil {
+		return err
+	}
+
+	err = service.userData.DeleteCode(user.CodePurposeChangeEmail, emailChangeCodeSubject(userId, pending.NewEmail))
+	if err != nil {
+		return err
+	}
+	return service.userData.RevokeOtherSessions(userId, exceptSessionId)
+}
+
+// checkEmailAvailable returns an error when email belongs to an account
+func (service *userService) checkEmailAvailable(email string) error {
+	_, err := service.userData.SelectByEmail(email)
+	if err == nil {
+		return errors.New("email sudah digunakan")
+	}
+	if errors.Is(err, user.ErrEmailNotFound) {
+		return nil
+	}
+	return err
+}
+
+// BeginOAuth implements user.UserServiceInterface.
+// It creates the state and the PKCE verifier of one redirect to provider,
+// a linkUserId other than 0 links the provider account to that user on callback.
+func (service *userService) BeginOAuth(provider, redirectURI string, linkUserId int) (*user.OAuthStateCore, error) {
+	if provider != user.LoginMethodGoogle && provider != user.LoginMethodFacebook {
+		return nil, errors.New("provider tidak didukung")
+	}
+	if redirectURI != "" && !slices.Contains(service.cfg.OAUTH_REDIRECT_URIS, redirectURI) {
+		return nil, errors.New("redirect_uri tidak diizinkan")
+	}
+
+	state, err := encrypts.GenerateRandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	// 32 random bytes encode to 43 characters, the shortest verifier RFC 7636 allows
+	verifier, err := encrypts.GenerateRandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	result := user.OAuthStateCore{
+		State:       state,
+		Provider:    provider,
+		Verifier:    verifier,
+		RedirectURI: redirectURI,
+		LinkUserID:  uint(linkUserId),
+	}
+	err = service.userData.CreateOAuthState(result, service.cfg.OAUTH_STATE_TTL)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// FinishOAuth implements user.UserServiceInterface.
+func (service *userService) FinishOAuth(provider, state string) (*user.OAuthStateCore, error) {
+	if state == "" {
+		return nil, errors.New("state oauth wajib diisi")
+	}
+
+	result, err := service.userData.ConsumeOAuthState(state)
+	if err != nil {
+		return nil, err
+	}
+	if result.Provider != provider {
+		return nil, errors.New("state oauth tidak valid")
+	}
+	return result, nil
+}
+
+// RequestCode implements user.UserServiceInterface.
+func (service *userService) RequestCode(purpose, email string) (data *user.Core, code string, err error) {
+	if email == "" {
+		return nil, "", errors.New("email harus di isi")
+	}
+
+	data, err = service.userData.SelectByEmail(email)
+	if err != nil {
+		return nil, "", err
+	}
+
+	code, err = generateCode()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// the resend cooldown is enforced by the rate limiter in front of the route
+	err = service.userData.CreateCode(purpose, email, code)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, code, nil
+}
+
+// ResetPasswordCode implements user.UserServiceInterface.
+func (service *userService) ResetPasswordCode(email, newPassword, code string) error {
+	// the code is checked first, nothing about the account or its passwords
+	// is looked at for a caller that doesn't hold it
+	err := service.userData.CheckCode(user.CodePurposeResetPassword, email, code)
+	if err != nil {
+		return err
+	}
+
+	data, err := service.userData.SelectByEmail(email)
+	if errors.Is(err, user.ErrEmailNotFound) {
+		return errors.New("kode tidak ditemukan")
+	}
+	if err != nil {
+		return err
+	}
+
+	// a rejected password leaves the code usable for another try
+	err = service.validateNewPassword(data, newPassword)
+	if err != nil {
+		return err
+	}
+
+	err = service.userData.ConsumeCode(user.CodePurposeResetPassword, email, code)
+	if err != nil {
+		return err
+	}
+
+	hashedNewPass, errHash := service.hashService.HashPassword(newPassword)
+	if errHash != nil {
+		return errors.New("error hash password")
+	}
+
+	err = service.userData.ResetPasswordCode(email, hashedNewPass)
+	if err != nil {
+		return err
+	}
+
+	return service.userData.RevokeOtherSessions(int(data.ID), 0)
+}
+
+// VerifyEmailCode implements user.UserServiceInterface.
+func (service *userService) VerifyEmailCode(email, code string) error {
+	err := service.userData.VerifyCode(user.CodePurposeVerifyEmail, email, code)
+	if err != nil {
+		return err
+	}
+
+	verification := true
+
+	err = service.userData.VerifyEmailCode(email, verification)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SelectByEmail implements user.UserServiceInterface.
+func (service *userService) SelectByEmail(email string) (*user.Core, error) {
+	user, err := service.userData.SelectByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// LoginWithProvider implements user.UserServiceInterface.
+// input is the profile returned by the provider. Users are found by the identity
+// of the provider account, the account is created and linked on first sign in.
+func (service *userService) LoginWithProvider(input user.Core, identity user.IdentityCore, session user.SessionCore) (data *user.Core, token *user.TokenCore, err error) {
+	if identity.Subject == "" {
+		return nil, nil, errors.New("akun provider tidak memiliki id")
+	}
+
+	linked, err := service.userData.SelectIdentity(identity.Provider, identity.Subject)
+	switch {
+	case err == nil:
+		data, err = service.userData.SelectById(int(linked.UserID))
+	case errors.Is(err, user.ErrIdentityNotFound):
+		data, err = service.linkProviderAccount(input, identity)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return service.providerSession(data, identity.Provider, session)
+}
+
+// providerSession signs data in through a provider like Login does, asking for the second factor first
+func (service *userService) providerSession(data *user.Core, provider string, session user.SessionCore) (*user.Core, *user.TokenCore, error) {
+	if data.TotpEnabled || data.EmailOtpEnabled {
+		token, err := service.startSecondFactor(data, provider)
+		if err != nil {
+			return nil, nil, err
+		}
+		return data, token, nil
+	}
+
+	session.UserID = data.ID
+	session.LoginMethod = provider
+	token, err := service.createSession(session)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, token, nil
+}
+
+// linkProviderAccount creates the user of a provider account signing in for the first
+// time. When its email belongs to a user already, the identity is only linked right away
+// for a provider-verified email of an account without password this provider registered
+// before user_identities existed, or of any account with OAUTH_AUTO_LINK on. Otherwise a *user.LinkRequiredError
+// asks the owner to prove ownership.
+func (service *userService) linkProviderAccount(input user.Core, identity user.IdentityCore) (*user.Core, error) {
+	if input.Email == "" {
+		return nil, errors.New("akun provider tidak memiliki email")
+	}
+
+	data, err := service.userData.SelectByEmail(input.Email)
+	switch {
+	case errors.Is(err, user.ErrEmailNotFound):
+		// the new account would be linked and marked verified on an email nobody proved,
+		// the real owner couldn't take it back from the provider account
+		if !identity.EmailVerified {
+			return nil, user.ErrProviderEmailUnverified
+		}
+		input.Verified = true
+
+		// a concurrent callback of the same account fails on the unique email,
+		// signing in again finds the identity it linked
+		err = service.userData.Insert(input)
+		if err != nil {
+			return nil, err
+		}
+		data, err = service.userData.SelectByEmail(input.Email)
+	case err == nil:
+		err = service.checkAutoLink(data, identity)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = service.LinkIdentity(int(data.ID), identity)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// checkAutoLink returns a *user.LinkRequiredError unless identity may be linked to the
+// existing user data without proof of ownership
+func (service *userService) checkAutoLink(data *user.Core, identity user.IdentityCore) error {
+	if service.cfg.OAUTH_AUTO_LINK && identity.EmailVerified {
+		return nil
+	}
+
+	// an account with a password or created another way is never signed in on the email
+	// alone, and neither is one matched on an email the provider didn't verify
+	if identity.EmailVerified && data.Password == "" && strings.EqualFold(data.RegistrationType, identity.Provider) {
+		identities, err := service.userData.SelectIdentitiesByUser(int(data.ID))
+		if err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(identities, func(v user.IdentityCore) bool { return v.Provider == identity.Provider }) {
+			return nil
+		}
+	}
+
+	linkToken, err := encrypts.GenerateRandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	err = service.userData.CreatePendingLink(user.PendingLinkCore{
+		Token:    linkToken,
+		UserID:   data.ID,
+		Identity: identity,
+	}, pendingLinkExpiration)
+	if err != nil {
+		return err
+	}
+
+	return &user.LinkRequiredError{
+		LinkToken:   linkToken,
+		Provider:    identity.Provider,
+		Email:       data.Email,
+		HasPassword: data.Password != "",
+	}
+}
+
+// RequestLinkCode implements user.UserServiceInterface.
+// The code goes to the email of the existing account.
+func (service *userService) RequestLinkCode(linkToken string) (data *user.Core, code string, err error) {
+	pending, err := service.userData.SelectPendingLink(linkToken)
+	if err != nil {
+		return nil, "", err
+	}
+
+	data, err = service.userData.SelectById(int(pending.UserID))
+	if err != nil {
+		return nil, "", err
+	}
+
+	code, err = generateCode()
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = service.userData.CreateCode(user.CodePurposeLinkIdentity, data.Email, code)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, code, nil
+}
+
+// ConfirmLink implements user.UserServiceInterface.
+// The owner proves ownership with the password, which counts towards the login
+// lockout, or with the emailed code, then the identity is linked and signed in.
+func (service *userService) ConfirmLink(linkToken, password, code string, session user.SessionCore) (data *user.Core, token *user.TokenCore, err error) {
+	pending, err := service.userData.SelectPendingLink(linkToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err = service.userData.SelectById(int(pending.UserID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case password != "":
+		accountKey := "account:" + strings.ToLower(data.Email)
+		ipKey := "ip:" + session.IPAddress
+		err = service.checkLoginBlock(accountKey, ipKey)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if data.Password == "" || !service.hashService.CheckPasswordHash(data.Password, password) {
+			if errFailure := service.recordLoginFailure(data, accountKey, ipKey); errFailure != nil {
+				return nil, nil, errFailure
+			}
+			return nil, nil, errors.New("password tidak sesuai")
+		}
+
+		err = service.userData.ResetLoginFailures(accountKey)
+		if err != nil {
+			return nil, nil, err
+		}
+	case code != "":
+		err = service.userData.VerifyCode(user.CodePurposeLinkIdentity, data.Email, code)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// the code proves ownership of the address too
+		if !data.Verified {
+			err = service.userData.VerifyEmailLink(int(data.ID), true)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	default:
+		return nil, nil, errors.New("password atau kode wajib diisi")
+	}
+
+	err = service.userData.DeletePendingLink(linkToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = service.LinkIdentity(int(data.ID), pending.Identity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return service.providerSession(data, pending.Identity.Provider, session)
+}
+
+// GetIdentities implements user.UserServiceInterface.
+func (service *userService) GetIdentities(userId int) ([]user.IdentityCore, error) {
+	return service.userData.SelectIdentitiesByUser(userId)
+}
+
+// LinkIdentity implements user.UserServiceInterface.
+func (service *userService) LinkIdentity(userId int, identity user.IdentityCore) error {
+	if identity.Subject == "" {
+		return errors.New("akun provider tidak memiliki id")
+	}
+
+	linked, err := service.userData.SelectIdentity(identity.Provider, identity.Subject)
+	if err == nil {
+		if linked.UserID == uint(userId) {
+			return errors.New("akun provider sudah terhubung ke akun ini")
+		}
+		return errors.New("akun provider sudah terhubung ke akun lain")
+	}
+	if !errors.Is(err, user.ErrIdentityNotFound) {
+		return err
+	}
+
+	identity.UserID = uint(userId)
+	identity.LinkedAt = time.Now()
+	return service.userData.InsertIdentity(identity)
+}
+
+// UnlinkIdentity implements user.UserServiceInterface.
+func (service *userService) UnlinkIdentity(userId int, identityId uint) error {
+	identities, err := service.userData.SelectIdentitiesByUser(userId)
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(identities, func(v user.IdentityCore) bool { return v.ID == identityId }) {
+		return errors.New("error record not found")
+	}
+
+	err = service.checkOtherLoginMethod(userId)
+	if err != nil {
+		return err
+	}
+	return service.userData.DeleteIdentity(userId, identityId)
+}
+
+// checkOtherLoginMethod returns an error when the password, the linked identities and
+// the passkeys of a user add up to a single login method, which must not be removed
+func (service *userService) checkOtherLoginMethod(userId int) error {
+	data, err := service.userData.SelectById(userId)
+	if err != nil {
+		return err
+	}
+
+	identities, err := service.userData.SelectIdentitiesByUser(userId)
+	if err != nil {
+		return err
+	}
+
+	passkeys, err := service.userData.SelectPasskeysByUser(userId)
+	if err != nil {
+		return err
+	}
+
+	methods := len(identities) + len(passkeys)
+	if data.Password != "" {
+		methods++
+	}
+	if methods <= 1 {
+		return errors.New("tidak bisa melepas metode login terakhir")
+	}
 	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"emailnotifl3n/app/config"
 	"emailnotifl3n/app/database"
 	"emailnotifl3n/app/router"
+	"emailnotifl3n/utils/middlewares"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -14,8 +15,10 @@ func main() {
 	cfg := config.InitConfig()
 	dbSql := database.InitDBPostgres(cfg)
 	cacheRds := cache.InitRedis()
+	middlewares.InitKeySet()
 
 	e := echo.New()
+	e.IPExtractor = middlewares.IPExtractor(cfg.TRUSTED_PROXIES)
 	e.Use(middleware.CORS())
 	e.Pre(middleware.RemoveTrailingSlash())
 
@@ -23,7 +26,7 @@ func main() {
 		Format: `[${time_rfc3339}] ${status} ${method} ${host}${path} ${latency_human}` + "\n",
 	}))
 
-	router.InitRouter(dbSql, e, cacheRds)
+	router.InitRouter(dbSql, e, cacheRds, cfg)
 	//start server and port
 	e.Logger.Fatal(e.Start(":8000"))
 }
@@ -0,0 +1,124 @@
+package breach
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// file layout: magic, number of hash functions (uint32), number of bits (uint64), bits
+var filterMagic = []byte("BRF1")
+
+// Filter is a bloom filter over SHA-1 digests of passwords, the same digests
+// HIBP publishes, so it can be built from their hash lists without plain text
+type Filter struct {
+	k    uint32
+	m    uint64
+	bits []byte
+}
+
+// NewFilter sizes a filter for n passwords with a false positive rate of p
+func NewFilter(n uint64, p float64) *Filter {
+	if n == 0 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+	return &Filter{k: k, m: m, bits: make([]byte, (m+7)/8)}
+}
+
+// ReadFilter loads a filter written by WriteTo
+func ReadFilter(r io.Reader) (*Filter, error) {
+	header := make([]byte, len(filterMagic)+12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("breach: read header: %w", err)
+	}
+	if string(header[:len(filterMagic)]) != string(filterMagic) {
+		return nil, errors.New("breach: not a breached password filter")
+	}
+
+	f := &Filter{
+		k: binary.BigEndian.Uint32(header[4:8]),
+		m: binary.BigEndian.Uint64(header[8:16]),
+	}
+	if f.k == 0 || f.m == 0 {
+		return nil, errors.New("breach: invalid filter header")
+	}
+	f.bits = make([]byte, (f.m+7)/8)
+	if _, err := io.ReadFull(r, f.bits); err != nil {
+		return nil, fmt.Errorf("breach: read bits: %w", err)
+	}
+	return f, nil
+}
+
+// WriteTo implements io.WriterTo.
+func (f *Filter) WriteTo(w io.Writer) (int64, error) {
+	header := make([]byte, 16)
+	copy(header, filterMagic)
+	binary.BigEndian.PutUint32(header[4:8], f.k)
+	binary.BigEndian.PutUint64(header[8:16], f.m)
+
+	bw := bufio.NewWriter(w)
+	n, err := bw.Write(header)
+	if err != nil {
+		return int64(n), err
+	}
+	written, err := bw.Write(f.bits)
+	if err != nil {
+		return int64(n + written), err
+	}
+	return int64(n + written), bw.Flush()
+}
+
+// AddDigest adds the SHA-1 digest of a password
+func (f *Filter) AddDigest(digest [sha1.Size]byte) {
+	h1, h2 := split(digest)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// Add adds a plain text password
+func (f *Filter) Add(password string) {
+	f.AddDigest(sha1.Sum([]byte(password)))
+}
+
+// Contains reports whether password may have been added, false positives happen at the configured rate
+func (f *Filter) Contains(password string) bool {
+	h1, h2 := split(sha1.Sum([]byte(password)))
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseDigest reads a line of a HIBP hash list, "<40 hex digits>[:count]"
+func ParseDigest(line string) ([sha1.Size]byte, error) {
+	var digest [sha1.Size]byte
+	hash, _, _ := strings.Cut(strings.TrimSpace(line), ":")
+	if len(hash) != hex.EncodedLen(sha1.Size) {
+		return digest, fmt.Errorf("breach: invalid sha1 %q", hash)
+	}
+	_, err := hex.Decode(digest[:], []byte(hash))
+	return digest, err
+}
+
+// double hashing, the digest is already uniformly distributed
+func split(digest [sha1.Size]byte) (uint64, uint64) {
+	h1 := binary.BigEndian.Uint64(digest[0:8])
+	h2 := binary.BigEndian.Uint64(digest[8:16]) | 1
+	return h1, h2
+}
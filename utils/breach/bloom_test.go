@@ -0,0 +1,136 @@
+package breach
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"emailnotifl3n/app/config"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilterContains(t *testing.T) {
+	f := NewFilter(1000, 0.001)
+	for i := 0; i < 1000; i++ {
+		f.Add(fmt.Sprintf("breached-%d", i))
+	}
+
+	// a bloom filter never forgets what was added
+	for i := 0; i < 1000; i++ {
+		if !f.Contains(fmt.Sprintf("breached-%d", i)) {
+			t.Fatalf("breached-%d not found", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.Contains(fmt.Sprintf("fresh-%d", i)) {
+			falsePositives++
+		}
+	}
+	// ten times the configured rate leaves room for chance
+	if falsePositives > 100 {
+		t.Fatalf("%d false positives in 10000 lookups", falsePositives)
+	}
+}
+
+func TestFilterRoundTrip(t *testing.T) {
+	f := NewFilter(100, 0.01)
+	f.Add("password123")
+
+	var buf bytes.Buffer
+	n, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Fatalf("WriteTo reported %d bytes, wrote %d", n, buf.Len())
+	}
+
+	loaded, err := ReadFilter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.k != f.k || loaded.m != f.m || !bytes.Equal(loaded.bits, f.bits) {
+		t.Fatal("loaded filter differs from the written one")
+	}
+	if !loaded.Contains("password123") {
+		t.Fatal("loaded filter lost a password")
+	}
+}
+
+func TestReadFilterRejectsInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	NewFilter(100, 0.01).WriteTo(&buf)
+	valid := buf.Bytes()
+
+	tests := map[string][]byte{
+		"empty":       nil,
+		"wrong magic": append([]byte("NOPE"), valid[4:]...),
+		"zero hashes": append(append([]byte{}, valid[:4]...), append([]byte{0, 0, 0, 0}, valid[8:]...)...),
+		"truncated":   valid[:len(valid)-1],
+	}
+	for name, data := range tests {
+		if _, err := ReadFilter(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: filter accepted", name)
+		}
+	}
+}
+
+func TestParseDigest(t *testing.T) {
+	sum := sha1.Sum([]byte("password"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	for _, line := range []string{hash, hash + ":9545824", " " + hash + ":1\r\n"} {
+		digest, err := ParseDigest(line)
+		if err != nil {
+			t.Fatalf("ParseDigest(%q): %v", line, err)
+		}
+		if digest != sum {
+			t.Fatalf("ParseDigest(%q) = %x", line, digest)
+		}
+	}
+
+	// a digest from a HIBP list matches the plain text password
+	f := NewFilter(10, 0.01)
+	digest, _ := ParseDigest(hash + ":9545824")
+	f.AddDigest(digest)
+	if !f.Contains("password") {
+		t.Fatal("password added by digest not found")
+	}
+
+	for _, line := range []string{"", "abc", hash[:39] + "Z"} {
+		if _, err := ParseDigest(line); err == nil {
+			t.Errorf("ParseDigest(%q) accepted", line)
+		}
+	}
+}
+
+func TestNewWithFilterFile(t *testing.T) {
+	if New(&config.AppConfig{}).IsBreached("password") {
+		t.Fatal("password breached without a filter")
+	}
+
+	f := NewFilter(10, 0.01)
+	f.Add("password")
+	path := filepath.Join(t.TempDir(), "breached.bloom")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteTo(file); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	checker := New(&config.AppConfig{BREACH_FILTER: path})
+	if !checker.IsBreached("password") {
+		t.Fatal("breached password passed")
+	}
+	if checker.IsBreached("a much longer unlisted passphrase") {
+		t.Fatal("unlisted password reported as breached")
+	}
+}
@@ -0,0 +1,44 @@
+package breach
+
+import (
+	"emailnotifl3n/app/config"
+	"log"
+	"os"
+)
+
+type BreachInterface interface {
+	// IsBreached reports whether password is part of the local breach corpus
+	IsBreached(password string) bool
+}
+
+type breach struct {
+	filter *Filter
+}
+
+// New loads the filter at config BREACH_FILTER, without one every password passes
+func New(cfg *config.AppConfig) BreachInterface {
+	if cfg.BREACH_FILTER == "" {
+		return &breach{}
+	}
+
+	file, err := os.Open(cfg.BREACH_FILTER)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	filter, err := ReadFilter(file)
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("breached password filter loaded: %d bits, %d hash functions", filter.m, filter.k)
+	return &breach{filter: filter}
+}
+
+// IsBreached implements BreachInterface.
+func (b *breach) IsBreached(password string) bool {
+	if b.filter == nil {
+		return false
+	}
+	return b.filter.Contains(password)
+}
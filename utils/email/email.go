@@ -15,6 +15,8 @@ type emailData struct {
 	URL     string
 	Name    string
 	Subject string
+	Code    string
+	Email   string
 }
 
 type emailService struct {
@@ -31,6 +33,14 @@ type EmailInterface interface {
 	SendVerificationLink(user *user.Core, token string) error
 	SendCodeResetPassword(user *user.Core, code string) error
 	SendCodeResetEmail(user *user.Core, code string) error
+	SendLoginCode(user *user.Core, code string) error
+	SendLinkCode(user *user.Core, code string) error
+	SendMagicLink(user *user.Core, token string) error
+	SendAccountLocked(user *user.Core, token string) error
+	SendPasswordChanged(user *user.Core, token string) error
+	SendEmailChangeConfirmation(user *user.Core, newEmail, token, code string) error
+	SendEmailChangeNotice(user *user.Core, newEmail, token string) error
+	SendUnknownAccountNotice(email string) error
 }
 
 func New() EmailInterface {
@@ -47,126 +57,131 @@ func New() EmailInterface {
 }
 
 func (e *emailService) SendResetPasswordLink(user *user.Core, token string) error {
-	t, err := template.ParseGlob("utils/templates/resetpasswordlink.html")
-	if err != nil {
-		return err
-	}
-
-	to := user.Email
 	data := &emailData{
 		URL:     e.url + "/reset-password?token=" + token,
 		Name:    user.Name,
 		Subject: "Reset Password",
 	}
-
-	var body bytes.Buffer
-	if err := t.Execute(&body, data); err != nil {
-		return err
-	}
-
-	m := gomail.NewMessage()
-
-	m.SetHeader("From", e.from)
-	m.SetHeader("To", to)
-	m.SetHeader("Subject", data.Subject)
-	m.SetBody("text/html", body.String())
-	m.AddAlternative("text/plain", html2text.HTML2Text(body.String()))
-
-	d := gomail.NewDialer(e.host, e.port, e.user, e.password)
-	d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-
-	// Send Email
-	if err := d.DialAndSend(m); err != nil {
-		return err
-	}
-	return nil
+	return e.sendTemplate(user.Email, "utils/templates/resetpasswordlink.html", data)
 }
 
 func (e *emailService) SendVerificationLink(user *user.Core, token string) error {
-	t, err := template.ParseGlob("utils/templates/verifiedlink.html")
-	if err != nil {
-		return err
-	}
-
-	to := user.Email
 	data := &emailData{
 		URL:     e.url + "/verification?token=" + token,
 		Name:    user.Name,
 		Subject: "Email Verification",
 	}
+	return e.sendTemplate(user.Email, "utils/templates/verifiedlink.html", data)
+}
 
-	var body bytes.Buffer
-	if err := t.Execute(&body, data); err != nil {
-		return err
+func (e *emailService) SendCodeResetPassword(user *user.Core, code string) error {
+	data := &emailData{
+		URL:     code,
+		Name:    user.Name,
+		Subject: "Reset Password Code",
 	}
+	return e.sendTemplate(user.Email, "utils/templates/resetpasswordcode.html", data)
+}
 
-	m := gomail.NewMessage()
-
-	m.SetHeader("From", e.from)
-	m.SetHeader("To", to)
-	m.SetHeader("Subject", data.Subject)
-	m.SetBody("text/html", body.String())
-	m.AddAlternative("text/plain", html2text.HTML2Text(body.String()))
-
-	d := gomail.NewDialer(e.host, e.port, e.user, e.password)
-	d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-
-	// Send Email
-	if err := d.DialAndSend(m); err != nil {
-		return err
+// SendCodeResetEmail implements EmailInterface.
+func (e *emailService) SendCodeResetEmail(user *user.Core, code string) error {
+	data := &emailData{
+		URL:     code,
+		Name:    user.Name,
+		Subject: "Verified Email Code",
 	}
-	return nil
+	return e.sendTemplate(user.Email, "utils/templates/resetpasswordcode.html", data)
 }
 
-func (e *emailService) SendCodeResetPassword(user *user.Core, code string) error {
-	t, err := template.ParseGlob("utils/templates/resetpasswordcode.html")
-	if err != nil {
-		return err
+// SendLoginCode implements EmailInterface.
+func (e *emailService) SendLoginCode(user *user.Core, code string) error {
+	data := &emailData{
+		Code:    code,
+		Name:    user.Name,
+		Subject: "Login Code",
 	}
+	return e.sendTemplate(user.Email, "utils/templates/logincode.html", data)
+}
 
+// SendLinkCode implements EmailInterface.
+func (e *emailService) SendLinkCode(user *user.Core, code string) error {
 	data := &emailData{
 		URL:     code,
 		Name:    user.Name,
-		Subject: "Reset Password Code",
+		Subject: "Link Account Code",
 	}
+	return e.sendTemplate(user.Email, "utils/templates/resetpasswordcode.html", data)
+}
 
-	var body bytes.Buffer
-	if err := t.Execute(&body, data); err != nil {
-		return err
+// SendMagicLink implements EmailInterface.
+func (e *emailService) SendMagicLink(user *user.Core, token string) error {
+	data := &emailData{
+		URL:     e.url + "/login/magic-link/callback?token=" + token,
+		Name:    user.Name,
+		Subject: "Sign In Link",
 	}
+	return e.sendTemplate(user.Email, "utils/templates/magiclink.html", data)
+}
 
-	m := gomail.NewMessage()
+// SendAccountLocked implements EmailInterface.
+func (e *emailService) SendAccountLocked(user *user.Core, token string) error {
+	data := &emailData{
+		URL:     e.url + "/unlock-account?token=" + token,
+		Name:    user.Name,
+		Subject: "Account Locked",
+	}
+	return e.sendTemplate(user.Email, "utils/templates/accountlocked.html", data)
+}
 
-	m.SetHeader("From", e.from)
-	m.SetHeader("To", user.Email)
-	m.SetHeader("Subject", data.Subject)
-	m.SetBody("text/html", body.String())
-	m.AddAlternative("text/plain", html2text.HTML2Text(body.String()))
+// SendPasswordChanged implements EmailInterface.
+func (e *emailService) SendPasswordChanged(user *user.Core, token string) error {
+	data := &emailData{
+		URL:     e.url + "/lock-account?token=" + token,
+		Name:    user.Name,
+		Subject: "Password Changed",
+	}
+	return e.sendTemplate(user.Email, "utils/templates/passwordchanged.html", data)
+}
 
-	d := gomail.NewDialer(e.host, e.port, e.user, e.password)
-	d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+// SendEmailChangeConfirmation implements EmailInterface.
+// It goes to the new address, which is not the user's email yet.
+func (e *emailService) SendEmailChangeConfirmation(user *user.Core, newEmail, token, code string) error {
+	data := &emailData{
+		URL:     e.url + "/change-email/confirm?token=" + token,
+		Name:    user.Name,
+		Subject: "Confirm Email Change",
+		Code:    code,
+		Email:   newEmail,
+	}
+	return e.sendTemplate(newEmail, "utils/templates/emailchangeconfirm.html", data)
+}
 
-	// Send Email
-	if err := d.DialAndSend(m); err != nil {
-		return err
+// SendEmailChangeNotice implements EmailInterface.
+func (e *emailService) SendEmailChangeNotice(user *user.Core, newEmail, token string) error {
+	data := &emailData{
+		URL:     e.url + "/change-email/cancel?token=" + token,
+		Name:    user.Name,
+		Subject: "Email Change Requested",
+		Email:   newEmail,
 	}
-	return nil
+	return e.sendTemplate(user.Email, "utils/templates/emailchangenotice.html", data)
 }
 
+// SendUnknownAccountNotice implements EmailInterface.
+func (e *emailService) SendUnknownAccountNotice(email string) error {
+	data := &emailData{
+		Subject: "Account Request",
+	}
+	return e.sendTemplate(email, "utils/templates/unknownaccount.html", data)
+}
 
-// SendCodeResetEmail implements EmailInterface.
-func (e *emailService) SendCodeResetEmail(user *user.Core, code string) error {
-	t, err := template.ParseGlob("utils/templates/resetpasswordcode.html")
+// sendTemplate renders the html template at path and sends it with a plain text alternative
+func (e *emailService) sendTemplate(to string, path string, data *emailData) error {
+	t, err := template.ParseGlob(path)
 	if err != nil {
 		return err
 	}
 
-	data := &emailData{
-		URL:     code,
-		Name:    user.Name,
-		Subject: "Verified Email Code",
-	}
-
 	var body bytes.Buffer
 	if err := t.Execute(&body, data); err != nil {
 		return err
@@ -175,7 +190,7 @@ func (e *emailService) SendCodeResetEmail(user *user.Core, code string) error {
 	m := gomail.NewMessage()
 
 	m.SetHeader("From", e.from)
-	m.SetHeader("To", user.Email)
+	m.SetHeader("To", to)
 	m.SetHeader("Subject", data.Subject)
 	m.SetBody("text/html", body.String())
 	m.AddAlternative("text/plain", html2text.HTML2Text(body.String()))
@@ -188,4 +203,4 @@ func (e *emailService) SendCodeResetEmail(user *user.Core, code string) error {
 		return err
 	}
 	return nil
-}
\ No newline at end of file
+}
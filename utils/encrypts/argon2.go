@@ -0,0 +1,82 @@
+package encrypts
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	saltLength = 16
+	keyLength  = 32
+)
+
+// argon2Hash stores hashes in the PHC string format
+// $argon2id$v=19$m=<memory KiB>,t=<time>,p=<threads>$<salt>$<key>
+type argon2Hash struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+func (a *argon2Hash) match(hashed string) bool {
+	return strings.HasPrefix(hashed, "$argon2id$")
+}
+
+func (a *argon2Hash) hash(password string) (string, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.time, a.memory, a.threads, keyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.memory, a.time, a.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a *argon2Hash) verify(hashed string, password string) bool {
+	params, salt, key, err := a.decode(hashed)
+	if err != nil {
+		return false
+	}
+
+	other := argon2.IDKey([]byte(password), salt, uint32(params["t"]), uint32(params["m"]), uint8(params["p"]), uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+func (a *argon2Hash) outdated(hashed string) bool {
+	params, _, _, err := a.decode(hashed)
+	if err != nil {
+		return true
+	}
+	return params["m"] != int(a.memory) || params["t"] != int(a.time) || params["p"] != int(a.threads)
+}
+
+func (a *argon2Hash) decode(hashed string) (params map[string]int, salt []byte, key []byte, err error) {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 {
+		return nil, nil, nil, fmt.Errorf("argon2id: invalid hash format")
+	}
+	if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, nil, nil, fmt.Errorf("argon2id: unsupported version %s", parts[2])
+	}
+
+	params = parseParams(parts[3])
+	if params["m"] <= 0 || params["t"] <= 0 || params["p"] <= 0 || params["p"] > 255 {
+		return nil, nil, nil, fmt.Errorf("argon2id: invalid parameters")
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return params, salt, key, nil
+}
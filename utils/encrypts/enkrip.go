@@ -1,33 +1,141 @@
 package encrypts
 
 import (
+	"emailnotifl3n/app/config"
 	"log"
+	"strconv"
+	"strings"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+// supported password hashing algorithms, stored hashes are told apart by their prefix
+const (
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmScrypt   = "scrypt"
+)
+
 type HashInterface interface {
 	CheckPasswordHash(hashed string, input string) bool
 	HashPassword(input string) (string, error)
+	// NeedsRehash reports whether hashed was made with another algorithm or parameters than the configured ones
+	NeedsRehash(hashed string) bool
 }
 
-type hash struct{}
+// passwordHasher is one algorithm, it checks hashes with any parameters
+// but creates them with the configured ones
+type passwordHasher interface {
+	match(hashed string) bool
+	hash(password string) (string, error)
+	verify(hashed string, password string) bool
+	outdated(hashed string) bool
+}
+
+type hash struct {
+	current passwordHasher
+	hashers []passwordHasher
+}
 
-func New() HashInterface {
-	return &hash{}
+func New(cfg *config.AppConfig) HashInterface {
+	bcryptHasher := &bcryptHash{cost: cfg.BCRYPT_COST}
+	argon2Hasher := &argon2Hash{
+		time:    uint32(cfg.ARGON2_TIME),
+		memory:  uint32(cfg.ARGON2_MEMORY),
+		threads: uint8(cfg.ARGON2_THREADS),
+	}
+	scryptHasher := &scryptHash{n: cfg.SCRYPT_N, r: cfg.SCRYPT_R, p: cfg.SCRYPT_P}
+
+	h := &hash{
+		hashers: []passwordHasher{bcryptHasher, argon2Hasher, scryptHasher},
+	}
+	switch strings.ToLower(cfg.HASH_ALGORITHM) {
+	case AlgorithmArgon2id:
+		h.current = argon2Hasher
+	case AlgorithmScrypt:
+		h.current = scryptHasher
+	case AlgorithmBcrypt, "":
+		h.current = bcryptHasher
+	default:
+		log.Println("HASH - algoritma tidak dikenal, memakai bcrypt:", cfg.HASH_ALGORITHM)
+		h.current = bcryptHasher
+	}
+	return h
 }
 
 func (h *hash) HashPassword(password string) (string, error) {
-	result, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	result, err := h.current.hash(password)
 	if err != nil {
 		log.Println("HASH - terjadi kesalahan saat hash password, error", err.Error())
 		return "", err
 	}
 
-	return string(result), nil
+	return result, nil
 }
 
 func (h *hash) CheckPasswordHash(hashed string, password string) bool {
+	for _, hasher := range h.hashers {
+		if hasher.match(hashed) {
+			return hasher.verify(hashed, password) //true means login success
+		}
+	}
+	return false
+}
+
+func (h *hash) NeedsRehash(hashed string) bool {
+	if !h.current.match(hashed) {
+		return true
+	}
+	return h.current.outdated(hashed)
+}
+
+type bcryptHash struct {
+	cost int
+}
+
+func (b *bcryptHash) match(hashed string) bool {
+	return strings.HasPrefix(hashed, "$2a$") || strings.HasPrefix(hashed, "$2b$") || strings.HasPrefix(hashed, "$2y$")
+}
+
+func (b *bcryptHash) hash(password string) (string, error) {
+	result, err := bcrypt.GenerateFromPassword([]byte(password), b.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(result), nil
+}
+
+func (b *bcryptHash) verify(hashed string, password string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
-	return err == nil //true means login success
+	return err == nil
+}
+
+func (b *bcryptHash) outdated(hashed string) bool {
+	cost, err := bcrypt.Cost([]byte(hashed))
+	if err != nil {
+		return true
+	}
+	// GenerateFromPassword raises costs below the minimum to the default
+	want := b.cost
+	if want < bcrypt.MinCost {
+		want = bcrypt.DefaultCost
+	}
+	return cost != want
+}
+
+// parseParams reads "a=1,b=2" parameter lists of PHC style hashes
+func parseParams(s string) map[string]int {
+	params := map[string]int{}
+	for _, kv := range strings.Split(s, ",") {
+		key, val, found := strings.Cut(kv, "=")
+		if !found {
+			continue
+		}
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			continue
+		}
+		params[key] = n
+	}
+	return params
 }
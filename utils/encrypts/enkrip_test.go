@@ -0,0 +1,147 @@
+package encrypts
+
+import (
+	"emailnotifl3n/app/config"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// small parameters keep the tests fast, they are not meant for production
+func testConfig(algorithm string) *config.AppConfig {
+	return &config.AppConfig{
+		HASH_ALGORITHM: algorithm,
+		BCRYPT_COST:    4,
+		ARGON2_TIME:    1,
+		ARGON2_MEMORY:  64,
+		ARGON2_THREADS: 1,
+		SCRYPT_N:       16,
+		SCRYPT_R:       8,
+		SCRYPT_P:       1,
+	}
+}
+
+func TestHashRoundTrip(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		prefix    string
+	}{
+		{AlgorithmBcrypt, "$2a$04$"},
+		{AlgorithmArgon2id, "$argon2id$v=19$m=64,t=1,p=1$"},
+		{AlgorithmScrypt, "$scrypt$n=16,r=8,p=1$"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			h := New(testConfig(tt.algorithm))
+
+			hashed, err := h.HashPassword("correct horse battery staple")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(hashed, tt.prefix) {
+				t.Fatalf("hash %q does not start with %q", hashed, tt.prefix)
+			}
+			if !h.CheckPasswordHash(hashed, "correct horse battery staple") {
+				t.Fatal("correct password rejected")
+			}
+			if h.CheckPasswordHash(hashed, "correct horse battery stapler") {
+				t.Fatal("wrong password accepted")
+			}
+			if h.NeedsRehash(hashed) {
+				t.Fatal("fresh hash needs a rehash")
+			}
+
+			again, _ := h.HashPassword("correct horse battery staple")
+			if again == hashed {
+				t.Fatal("two hashes of the same password are equal, salt missing")
+			}
+		})
+	}
+}
+
+// RFC 7914 section 12, the second test vector
+func TestScryptKnownAnswer(t *testing.T) {
+	key, _ := hex.DecodeString("fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b373162" +
+		"2eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640")
+	hashed := "$scrypt$n=1024,r=8,p=16$" + base64.RawStdEncoding.EncodeToString([]byte("NaCl")) +
+		"$" + base64.RawStdEncoding.EncodeToString(key)
+
+	h := New(testConfig(AlgorithmScrypt))
+	if !h.CheckPasswordHash(hashed, "password") {
+		t.Fatal("RFC 7914 vector rejected")
+	}
+	if h.CheckPasswordHash(hashed, "Password") {
+		t.Fatal("wrong password accepted")
+	}
+	if !h.NeedsRehash(hashed) {
+		t.Fatal("hash with other parameters does not need a rehash")
+	}
+}
+
+func TestCheckAcrossAlgorithms(t *testing.T) {
+	hashes := map[string]string{}
+	for _, algorithm := range []string{AlgorithmBcrypt, AlgorithmArgon2id, AlgorithmScrypt} {
+		hashed, err := New(testConfig(algorithm)).HashPassword("s3cret-password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes[algorithm] = hashed
+	}
+
+	// every configuration checks every stored format, only other formats need a rehash
+	for _, current := range []string{AlgorithmBcrypt, AlgorithmArgon2id, AlgorithmScrypt} {
+		h := New(testConfig(current))
+		for algorithm, hashed := range hashes {
+			if !h.CheckPasswordHash(hashed, "s3cret-password") {
+				t.Errorf("%s config rejected a %s hash", current, algorithm)
+			}
+			if got := h.NeedsRehash(hashed); got != (algorithm != current) {
+				t.Errorf("%s config NeedsRehash(%s) = %v", current, algorithm, got)
+			}
+		}
+	}
+}
+
+func TestOutdatedParameters(t *testing.T) {
+	cfg := testConfig(AlgorithmArgon2id)
+	old, _ := New(cfg).HashPassword("s3cret-password")
+	cfg.ARGON2_TIME = 2
+	if !New(cfg).NeedsRehash(old) {
+		t.Error("argon2id hash with an old time cost does not need a rehash")
+	}
+
+	cfg = testConfig(AlgorithmScrypt)
+	old, _ = New(cfg).HashPassword("s3cret-password")
+	cfg.SCRYPT_N = 32
+	if !New(cfg).NeedsRehash(old) {
+		t.Error("scrypt hash with an old cost does not need a rehash")
+	}
+
+	cfg = testConfig(AlgorithmBcrypt)
+	old, _ = New(cfg).HashPassword("s3cret-password")
+	cfg.BCRYPT_COST = 5
+	if !New(cfg).NeedsRehash(old) {
+		t.Error("bcrypt hash with an old cost does not need a rehash")
+	}
+}
+
+func TestRejectsMalformedHashes(t *testing.T) {
+	h := New(testConfig(AlgorithmArgon2id))
+	for _, hashed := range []string{
+		"",
+		"plaintext",
+		"$argon2id$v=19$m=64,t=1,p=1$bm9zYWx0",
+		"$argon2id$v=18$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=0,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"$scrypt$n=1,r=8,p=1$c2FsdHNhbHQ$a2V5",
+		"$scrypt$n=16,r=8,p=1$!!$a2V5",
+	} {
+		if h.CheckPasswordHash(hashed, "") {
+			t.Errorf("malformed hash %q accepted", hashed)
+		}
+		if !h.NeedsRehash(hashed) {
+			t.Errorf("malformed hash %q does not need a rehash", hashed)
+		}
+	}
+}
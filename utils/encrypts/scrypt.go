@@ -0,0 +1,79 @@
+package encrypts
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scryptHash stores hashes as $scrypt$n=<cost>,r=<block size>,p=<parallelism>$<salt>$<key>
+type scryptHash struct {
+	n int
+	r int
+	p int
+}
+
+func (s *scryptHash) match(hashed string) bool {
+	return strings.HasPrefix(hashed, "$scrypt$")
+}
+
+func (s *scryptHash) hash(password string) (string, error) {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key, err := scrypt.Key([]byte(password), salt, s.n, s.r, s.p, keyLength)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$n=%d,r=%d,p=%d$%s$%s", s.n, s.r, s.p,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (s *scryptHash) verify(hashed string, password string) bool {
+	params, salt, key, err := s.decode(hashed)
+	if err != nil {
+		return false
+	}
+
+	other, err := scrypt.Key([]byte(password), salt, params["n"], params["r"], params["p"], len(key))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+func (s *scryptHash) outdated(hashed string) bool {
+	params, _, _, err := s.decode(hashed)
+	if err != nil {
+		return true
+	}
+	return params["n"] != s.n || params["r"] != s.r || params["p"] != s.p
+}
+
+func (s *scryptHash) decode(hashed string) (params map[string]int, salt []byte, key []byte, err error) {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 5 {
+		return nil, nil, nil, fmt.Errorf("scrypt: invalid hash format")
+	}
+
+	params = parseParams(parts[2])
+	if params["n"] <= 1 || params["r"] <= 0 || params["p"] <= 0 {
+		return nil, nil, nil, fmt.Errorf("scrypt: invalid parameters")
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return params, salt, key, nil
+}
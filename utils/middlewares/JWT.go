@@ -1,9 +1,9 @@
 package middlewares
 
 import (
-	"emailnotifl3n/app/config"
+	"emailnotifl3n/utils/encrypts"
+	"errors"
 	"fmt"
-	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -11,59 +11,160 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
-func JWTMiddleware() echo.MiddlewareFunc {
+// access tokens are short-lived, clients renew them with a refresh token
+const AccessTokenExpiration = 15 * time.Minute
+
+// values of the typ claim, both kinds share the signing keys so
+// each parser only accepts its own
+const (
+	TokenTypeAccess = "access"
+	TokenTypeAction = "action"
+)
+
+// TokenStore is consulted by JWTMiddleware for tokens revoked before their exp
+type TokenStore interface {
+	IsTokenRevoked(jti string) (bool, error)
+	IsSessionActive(sessionId uint) (bool, error)
+	SelectTokenVersion(userId int) (int, error)
+}
+
+// TokenClaims holds the claims of an access token validated by JWTMiddleware
+type TokenClaims struct {
+	UserID    int
+	SessionID uint
+	JTI       string
+	ExpiresAt time.Time
+}
+
+func JWTMiddleware(store TokenStore) echo.MiddlewareFunc {
 	return echojwt.WithConfig(echojwt.Config{
-		SigningKey:    []byte(config.JWT_SECRET),
-		SigningMethod: "HS256",
+		ParseTokenFunc: func(c echo.Context, auth string) (interface{}, error) {
+			tokenJWT, err := parseToken(auth)
+			if err != nil {
+				return nil, err
+			}
+
+			claims := tokenJWT.Claims.(jwt.MapClaims)
+			if typ, _ := claims["typ"].(string); typ != TokenTypeAccess {
+				return nil, errors.New("not an access token")
+			}
+
+			jti, ok := claims["jti"].(string)
+			if !ok || jti == "" {
+				return nil, errors.New("token has no jti")
+			}
+
+			revoked, err := store.IsTokenRevoked(jti)
+			if err != nil {
+				return nil, err
+			}
+			if revoked {
+				return nil, errors.New("token has been revoked")
+			}
+
+			sessionId, _ := claims["sid"].(float64)
+			active, err := store.IsSessionActive(uint(sessionId))
+			if err != nil {
+				return nil, err
+			}
+			if !active {
+				return nil, errors.New("session has ended")
+			}
+
+			// tokens issued before the last password change are stale
+			userId, _ := claims["userId"].(float64)
+			tokenVersion, _ := claims["ver"].(float64)
+			currentVersion, err := store.SelectTokenVersion(int(userId))
+			if err != nil {
+				return nil, err
+			}
+			if int(tokenVersion) != currentVersion {
+				return nil, errors.New("token is no longer valid")
+			}
+			return tokenJWT, nil
+		},
 	})
 }
 
 // Generate token jwt
-func CreateTokenLogin(userId int) (string, error) {
+func CreateTokenLogin(userId int, sessionId uint, tokenVersion int) (string, error) {
+	jti, err := encrypts.GenerateRandomToken(16)
+	if err != nil {
+		return "", err
+	}
+
 	claims := jwt.MapClaims{}
+	claims["typ"] = TokenTypeAccess
 	claims["authorized"] = true
 	claims["userId"] = userId
-	claims["exp"] = time.Now().Add(time.Hour * 24).Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(config.JWT_SECRET))
+	claims["sid"] = sessionId
+	claims["ver"] = tokenVersion
+	claims["jti"] = jti
+	claims["exp"] = time.Now().Add(AccessTokenExpiration).Unix()
+	return signToken(claims)
 }
 
-// extract token jwt
-func ExtractTokenUserId(e echo.Context) int {
-	header := e.Request().Header.Get("Authorization")
-	headerToken := strings.Split(header, " ")
-	token := headerToken[len(headerToken)-1]
-	tokenJWT, _ := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
-		return []byte(config.JWT_SECRET), nil
-	})
+// extract claims of the token validated by JWTMiddleware
+func ExtractTokenClaims(e echo.Context) TokenClaims {
+	var result TokenClaims
+	tokenJWT, ok := e.Get("user").(*jwt.Token)
+	if !ok {
+		return result
+	}
 
-	if tokenJWT.Valid {
-		claims := tokenJWT.Claims.(jwt.MapClaims)
-		userId, isValidUserId := claims["userId"].(float64)
-		if !isValidUserId {
-			return 0
-		}
-		return int(userId)
+	claims := tokenJWT.Claims.(jwt.MapClaims)
+	if userId, ok := claims["userId"].(float64); ok {
+		result.UserID = int(userId)
+	}
+	if sessionId, ok := claims["sid"].(float64); ok {
+		result.SessionID = uint(sessionId)
+	}
+	result.JTI, _ = claims["jti"].(string)
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		result.ExpiresAt = exp.Time
 	}
-	return 0
+	return result
 }
 
-func CreateResetPasswordToken(userId int) (string, error) {
+// extract user id of the token validated by JWTMiddleware,
+// returns 0 for missing, revoked or stale tokens
+func ExtractTokenUserId(e echo.Context) int {
+	return ExtractTokenClaims(e).UserID
+}
+
+// purposes of single-use action tokens sent by email
+const (
+	PurposeResetPassword = "reset_password"
+	PurposeVerifyEmail   = "verify_email"
+	PurposeChangeEmail   = "change_email"
+	PurposeMfaPending    = "mfa_pending"
+	PurposeMagicLogin    = "magic_login"
+	PurposeUnlockAccount = "unlock_account"
+	PurposeLockAccount   = "lock_account"
+	// cancels a pending email change, sent to the old address
+	PurposeCancelEmailChange = "cancel_email_change"
+)
+
+// CreateActionToken signs a token that is only accepted for purpose.
+// The nonce must be stored server side and consumed on first use.
+func CreateActionToken(userId int, purpose, nonce string, expiration time.Duration) (string, error) {
 	payload := map[string]interface{}{
-		"userId":        userId,
-		"resetPassword": true,
+		"userId":  userId,
+		"purpose": purpose,
+		"nonce":   nonce,
 	}
 
 	now := time.Now().UTC()
 
 	claims := jwt.MapClaims{
+		"typ": TokenTypeAction,
 		"sub": payload,
-		"exp": now.Add(time.Duration(time.Minute * 15)).Unix(),
+		"exp": now.Add(expiration).Unix(),
 		"iat": now.Unix(),
 		"nbf": now.Unix(),
 	}
 
-	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.JWT_SECRET))
+	token, err := signToken(claims)
 	if err != nil {
 		return "", fmt.Errorf("create: sign token: %w", err)
 	}
@@ -71,26 +172,38 @@ func CreateResetPasswordToken(userId int) (string, error) {
 	return token, nil
 }
 
-func ExtractUserIdFromResetPasswordToken(token string) (int, error) {
-	tokenJWT, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
-		return []byte(config.JWT_SECRET), nil
-	})
+// ExtractActionToken returns the user id and nonce of a token created for purpose
+func ExtractActionToken(token, purpose string) (userId int, nonce string, err error) {
+	tokenJWT, err := parseToken(token)
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 
 	if claims, ok := tokenJWT.Claims.(jwt.MapClaims); ok && tokenJWT.Valid {
+		if typ, _ := claims["typ"].(string); typ != TokenTypeAction {
+			return 0, "", fmt.Errorf("invalid token type")
+		}
+
 		payload, ok := claims["sub"].(map[string]interface{})
 		if !ok {
-			return 0, fmt.Errorf("invalid payload in token")
+			return 0, "", fmt.Errorf("invalid payload in token")
+		}
+
+		if tokenPurpose, _ := payload["purpose"].(string); tokenPurpose != purpose {
+			return 0, "", fmt.Errorf("invalid token purpose")
+		}
+
+		nonce, _ = payload["nonce"].(string)
+		if nonce == "" {
+			return 0, "", fmt.Errorf("invalid nonce in token")
 		}
 
 		userId, isValidUserId := payload["userId"].(float64)
 		if !isValidUserId {
-			return 0, fmt.Errorf("invalid user id in token")
+			return 0, "", fmt.Errorf("invalid user id in token")
 		}
-		return int(userId), nil
+		return int(userId), nonce, nil
 	}
 
-	return 0, fmt.Errorf("invalid token")
+	return 0, "", fmt.Errorf("invalid token")
 }
@@ -0,0 +1,211 @@
+package middlewares
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"emailnotifl3n/app/config"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// KeySet holds the key used to sign new tokens and every key still accepted
+// for verification, so keys can be rotated without invalidating live tokens.
+type KeySet struct {
+	active *signingKey
+	keys   map[string]*signingKey
+}
+
+var keySet = &KeySet{}
+
+// InitKeySet loads the PEM files listed in config.JWT_KEYS. The first file is
+// the active private key, the rest are older keys that are only verified.
+// Without any file, tokens are signed with HS256 and config.JWT_SECRET.
+func InitKeySet() {
+	set, err := LoadKeySet(config.JWT_KEYS)
+	if err != nil {
+		panic(err)
+	}
+	keySet = set
+}
+
+func LoadKeySet(paths []string) (*KeySet, error) {
+	set := &KeySet{keys: map[string]*signingKey{}}
+	for _, path := range paths {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		key, err := loadPEMKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("load jwt key %s: %w", path, err)
+		}
+
+		if set.active == nil {
+			if key.private == nil {
+				return nil, fmt.Errorf("load jwt key %s: active key must be a private key", path)
+			}
+			set.active = key
+		}
+		set.keys[key.kid] = key
+	}
+	return set, nil
+}
+
+func loadPEMKey(path string) (*signingKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.method, key.private, key.public = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.method, key.public = jwt.SigningMethodRS256, k
+	case ed25519.PrivateKey:
+		key.method, key.private, key.public = jwt.SigningMethodEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.method, key.public = jwt.SigningMethodEdDSA, k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	key.kid, err = thumbprint(key.toJWK())
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (k *signingKey) toJWK() jwk {
+	result := jwk{Kid: k.kid, Use: "sig", Alg: k.method.Alg()}
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		result.Kty = "RSA"
+		result.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		result.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		result.Kty = "OKP"
+		result.Crv = "Ed25519"
+		result.X = base64.RawURLEncoding.EncodeToString(pub)
+	}
+	return result
+}
+
+// thumbprint computes the RFC 7638 key id from the required JWK members
+func thumbprint(key jwk) (string, error) {
+	var canonical string
+	switch key.Kty {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, key.E, key.N)
+	case "OKP":
+		canonical = fmt.Sprintf(`{"crv":"%s","kty":"OKP","x":"%s"}`, key.Crv, key.X)
+	default:
+		return "", fmt.Errorf("unsupported key type %q", key.Kty)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// signToken signs claims with the active key, falling back to HS256
+func signToken(claims jwt.MapClaims) (string, error) {
+	if keySet.active == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.JWT_SECRET))
+	}
+
+	token := jwt.NewWithClaims(keySet.active.method, claims)
+	token.Header["kid"] = keySet.active.kid
+	return token.SignedString(keySet.active.private)
+}
+
+// parseToken verifies a token against the key named by its kid header.
+// HS256 is only accepted while no asymmetric key is configured.
+func parseToken(token string) (*jwt.Token, error) {
+	if keySet.active == nil {
+		return jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+			return []byte(config.JWT_SECRET), nil
+		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	}
+
+	return jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := keySet.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		if t.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+		}
+		return key.public, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
+}
+
+// JWKSHandler publishes the public keys so other services can verify tokens
+func JWKSHandler(c echo.Context) error {
+	keys := []jwk{}
+	for _, key := range keySet.keys {
+		keys = append(keys, key.toJWK())
+	}
+
+	c.Response().Header().Set(echo.HeaderCacheControl, "public, max-age=300")
+	body, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		return err
+	}
+	return c.Blob(http.StatusOK, "application/jwk-set+json", body)
+}
@@ -0,0 +1,131 @@
+package middlewares
+
+import (
+	"bytes"
+	"emailnotifl3n/app/cache"
+	"emailnotifl3n/utils/encrypts"
+	"emailnotifl3n/utils/responses"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RateLimitKeyFunc returns what a policy counts requests by, an empty key skips the policy
+type RateLimitKeyFunc func(c echo.Context) string
+
+// RateLimitPolicy allows Limit requests per key within a sliding Window
+type RateLimitPolicy struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+	Key    RateLimitKeyFunc
+}
+
+// RateLimit rejects a request with 429 and a Retry-After header as soon as one of the policies is exceeded.
+// Counters live in Redis, so they are shared between replicas and survive restarts.
+func RateLimit(store cache.Redis, policies ...RateLimitPolicy) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			for _, policy := range policies {
+				key := policy.Key(c)
+				if key == "" {
+					continue
+				}
+
+				allowed, retryAfter, err := store.AllowRequest(c.Request().Context(), "rate_limit:"+policy.Name+":"+key, policy.Limit, policy.Window)
+				if err != nil {
+					return err
+				}
+				if !allowed {
+					seconds := int(math.Ceil(retryAfter.Seconds()))
+					c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+					return c.JSON(http.StatusTooManyRequests, responses.WebResponse("too many requests, try again in "+strconv.Itoa(seconds)+" seconds", nil))
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// KeyByIP counts requests per client ip, as found by the IPExtractor of the server
+func KeyByIP(c echo.Context) string {
+	return c.RealIP()
+}
+
+// IPExtractor tells c.RealIP where the client address comes from. Without trusted
+// proxies it is the peer of the connection, X-Forwarded-For and X-Real-IP are ignored
+// since any client can send them. Behind proxies the header is read from the right,
+// skipping the listed ranges, so a forged entry on the left is never used.
+func IPExtractor(trustedProxies []string) echo.IPExtractor {
+	var options []echo.TrustOption
+	for _, v := range trustedProxies {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			log.Fatalf("TRUSTEDPROXIES - invalid CIDR %q: %v", v, err)
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	if len(options) == 0 {
+		return echo.ExtractIPDirect()
+	}
+
+	options = append(options, echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false))
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// KeyByUserID counts requests per logged in user, it must run after JWTMiddleware
+func KeyByUserID(c echo.Context) string {
+	userId := ExtractTokenUserId(c)
+	if userId == 0 {
+		return ""
+	}
+	return strconv.Itoa(userId)
+}
+
+// KeyByEmail counts requests per email field of the body
+func KeyByEmail(c echo.Context) string {
+	var input struct {
+		Email string `json:"email" form:"email"`
+	}
+	bindBody(c, &input)
+	return strings.ToLower(strings.TrimSpace(input.Email))
+}
+
+// KeyByLinkToken counts requests per pending oauth link, whatever ip they come from
+func KeyByLinkToken(c echo.Context) string {
+	var input struct {
+		LinkToken string `json:"link_token" form:"link_token"`
+	}
+	bindBody(c, &input)
+	if input.LinkToken == "" {
+		return ""
+	}
+	return encrypts.HashToken(input.LinkToken)
+}
+
+// bindBody reads the body into input and restores it so the handler can still bind it
+func bindBody(c echo.Context, input any) {
+	req := c.Request()
+	if req.Body == nil {
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	_ = (&echo.DefaultBinder{}).BindBody(c, input)
+	req.Body = io.NopCloser(bytes.NewReader(body))
+}
@@ -22,9 +22,9 @@ type FacebookOauthToken struct {
 }
 
 type FacebookInterface interface {
-	GetAuthURL() string
-	GetFacebookOauthToken(code string) (*FacebookOauthToken, error)
-	GetFacebookUser(access_token string) (*user.Core, error)
+	GetAuthURL(state, verifier string) string
+	GetFacebookOauthToken(code, verifier string) (*FacebookOauthToken, error)
+	GetFacebookUser(access_token string) (*user.Core, *user.IdentityCore, error)
 }
 
 func New() FacebookInterface {
@@ -40,13 +40,14 @@ func New() FacebookInterface {
 }
 
 // GetAuthURL implements FacebookInterface.
-func (facebook *FacebookOauth) GetAuthURL() string {
-	return facebook.oauthConfig.AuthCodeURL("state", oauth2.AccessTypeOffline)
+// Only the S256 challenge of verifier leaves the server.
+func (facebook *FacebookOauth) GetAuthURL(state, verifier string) string {
+	return facebook.oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
 }
 
 // GetFacebookOauthToken implements FacebookInterface.
-func (facebook *FacebookOauth) GetFacebookOauthToken(code string) (*FacebookOauthToken, error) {
-	token, err := facebook.oauthConfig.Exchange(context.Background(), code)
+func (facebook *FacebookOauth) GetFacebookOauthToken(code, verifier string) (*FacebookOauthToken, error) {
+	token, err := facebook.oauthConfig.Exchange(context.Background(), code, oauth2.VerifierOption(verifier))
 	if err != nil {
 		return nil, err
 	}
@@ -56,25 +57,25 @@ func (facebook *FacebookOauth) GetFacebookOauthToken(code string) (*FacebookOaut
 }
 
 // GetFacebookUser implements FacebookInterface.
-func (facebook *FacebookOauth) GetFacebookUser(access_token string) (*user.Core, error) {
+// The identity is keyed on the app scoped facebook user id.
+func (facebook *FacebookOauth) GetFacebookUser(access_token string) (*user.Core, *user.IdentityCore, error) {
 	response, err := http.Get("https://graph.facebook.com/me?fields=id,name,email,picture&access_token=" + url.QueryEscape(access_token))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer response.Body.Close()
 
 	if response.StatusCode != http.StatusOK {
-		return nil, errors.New("failed to get user info from Facebook")
+		return nil, nil, errors.New("failed to get user info from Facebook")
 	}
 
 	var fbUserRes map[string]interface{}
 	err = json.NewDecoder(response.Body).Decode(&fbUserRes)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	userBody := &user.Core{
-		Verified:         true,
 		RegistrationType: "Facebook",
 	}
 
@@ -93,5 +94,14 @@ func (facebook *FacebookOauth) GetFacebookUser(access_token string) (*user.Core,
 			}
 		}
 	}
-	return userBody, nil
+
+	// the graph api doesn't say whether the email was verified, so it never counts as verified
+	identity := &user.IdentityCore{
+		Provider: user.LoginMethodFacebook,
+		Email:    userBody.Email,
+	}
+	if id, ok := fbUserRes["id"].(string); ok {
+		identity.Subject = id
+	}
+	return userBody, identity, nil
 }
@@ -26,9 +26,9 @@ type GoogleOauthToken struct {
 }
 
 type GoogleInterface interface {
-	GetAuthURL() string
-	GetGoogleOauthToken(code string) (*GoogleOauthToken, error)
-	GetGoogleUser(access_token string, id_token string) (*user.Core, error)
+	GetAuthURL(state, verifier string) string
+	GetGoogleOauthToken(code, verifier string) (*GoogleOauthToken, error)
+	GetGoogleUser(access_token string, id_token string) (*user.Core, *user.IdentityCore, error)
 }
 
 func New() GoogleInterface {
@@ -44,12 +44,13 @@ func New() GoogleInterface {
 }
 
 // GetAuthURL implements GoogleInterface.
-func (google *GoogleOauth) GetAuthURL() string {
-	return google.oauthConfig.AuthCodeURL("state", oauth2.AccessTypeOffline)
+// Only the S256 challenge of verifier leaves the server.
+func (google *GoogleOauth) GetAuthURL(state, verifier string) string {
+	return google.oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier))
 }
 
 // GetGoogleOauthToken implements GoogleInterface.
-func (google *GoogleOauth) GetGoogleOauthToken(code string) (*GoogleOauthToken, error) {
+func (google *GoogleOauth) GetGoogleOauthToken(code, verifier string) (*GoogleOauthToken, error) {
 
 	const token = "https://oauth2.googleapis.com/token"
 	values := url.Values{}
@@ -58,6 +59,7 @@ func (google *GoogleOauth) GetGoogleOauthToken(code string) (*GoogleOauthToken,
 	values.Add("client_id", google.oauthConfig.ClientID)
 	values.Add("client_secret", google.oauthConfig.ClientSecret)
 	values.Add("redirect_uri", google.oauthConfig.RedirectURL)
+	values.Add("code_verifier", verifier)
 
 	query := values.Encode()
 
@@ -107,12 +109,13 @@ func (google *GoogleOauth) GetGoogleOauthToken(code string) (*GoogleOauthToken,
 }
 
 // GetGoogleUser implements GoogleInterface.
-func (google *GoogleOauth) GetGoogleUser(access_token string, id_token string) (*user.Core, error) {
+// The identity is keyed on the google account id, which stays the same when the email changes.
+func (google *GoogleOauth) GetGoogleUser(access_token string, id_token string) (*user.Core, *user.IdentityCore, error) {
 	rootUrl := fmt.Sprintf("https://www.googleapis.com/oauth2/v1/userinfo?alt=json&access_token=%s", access_token)
 
 	req, err := http.NewRequest("GET", rootUrl, nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", id_token))
@@ -123,27 +126,26 @@ func (google *GoogleOauth) GetGoogleUser(access_token string, id_token string) (
 
 	res, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if res.StatusCode != http.StatusOK {
-		return nil, errors.New("could not retrieve user")
+		return nil, nil, errors.New("could not retrieve user")
 	}
 
 	var resBody bytes.Buffer
 	_, err = io.Copy(&resBody, res.Body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var GoogleUserRes map[string]interface{}
 
 	if err := json.Unmarshal(resBody.Bytes(), &GoogleUserRes); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	userBody := &user.Core{
-		Verified:         true,
 		RegistrationType: "Google",
 	}
 
@@ -159,5 +161,16 @@ func (google *GoogleOauth) GetGoogleUser(access_token string, id_token string) (
 		userBody.PhotoProfile = picture
 	}
 
-	return userBody, nil
+	identity := &user.IdentityCore{
+		Provider: user.LoginMethodGoogle,
+		Email:    userBody.Email,
+	}
+	if id, ok := GoogleUserRes["id"].(string); ok {
+		identity.Subject = id
+	}
+	if verified, ok := GoogleUserRes["verified_email"].(bool); ok {
+		identity.EmailVerified = verified
+	}
+
+	return userBody, identity, nil
 }
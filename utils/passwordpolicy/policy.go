@@ -0,0 +1,135 @@
+package passwordpolicy
+
+import (
+	"emailnotifl3n/app/config"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// rules a password can break, sent to clients so they can show their own messages
+const (
+	RuleMinLength     = "min_length"
+	RuleCharClasses   = "character_classes"
+	RulePersonalInfo  = "personal_info"
+	RuleStrengthScore = "strength_score"
+	RuleBreached      = "breached"
+	RuleReused        = "reused"
+)
+
+// Violation is one rule a password breaks
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PolicyError lists every rule a password breaks
+type PolicyError struct {
+	Violations []Violation
+}
+
+func (e *PolicyError) Error() string {
+	var messages []string
+	for _, v := range e.Violations {
+		messages = append(messages, v.Message)
+	}
+	return strings.Join(messages, ", ")
+}
+
+// Add appends a violation, it lets other checks report through the same error
+func (e *PolicyError) Add(rule, message string) {
+	e.Violations = append(e.Violations, Violation{Rule: rule, Message: message})
+}
+
+type PolicyInterface interface {
+	// Validate returns a *PolicyError when password breaks a rule.
+	// userInputs are the email and name of the account.
+	Validate(password string, userInputs ...string) error
+}
+
+type policy struct {
+	minLength     int
+	minClasses    int
+	checkPersonal bool
+	minScore      int
+}
+
+func New(cfg *config.AppConfig) PolicyInterface {
+	return &policy{
+		minLength:     cfg.PASSWORD_MIN_LENGTH,
+		minClasses:    cfg.PASSWORD_MIN_CLASSES,
+		checkPersonal: cfg.PASSWORD_CHECK_PERSONAL,
+		minScore:      cfg.PASSWORD_MIN_SCORE,
+	}
+}
+
+// Validate implements PolicyInterface.
+func (p *policy) Validate(password string, userInputs ...string) error {
+	result := &PolicyError{}
+
+	if utf8.RuneCountInString(password) < p.minLength {
+		result.Add(RuleMinLength, fmt.Sprintf("password minimal %d karakter", p.minLength))
+	}
+
+	if characterClasses(password) < p.minClasses {
+		result.Add(RuleCharClasses, fmt.Sprintf("password harus memuat minimal %d dari huruf kecil, huruf besar, angka dan simbol", p.minClasses))
+	}
+
+	tokens := personalTokens(userInputs)
+	if p.checkPersonal {
+		lower := strings.ToLower(password)
+		for _, token := range tokens {
+			if strings.Contains(lower, token) {
+				result.Add(RulePersonalInfo, "password tidak boleh memuat bagian dari email atau nama")
+				break
+			}
+		}
+	}
+
+	if p.minScore > 0 && Score(password, tokens...) < p.minScore {
+		result.Add(RuleStrengthScore, "password terlalu mudah ditebak")
+	}
+
+	if len(result.Violations) > 0 {
+		return result
+	}
+	return nil
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+// personalTokens splits emails and names into the words someone would build a password from,
+// only the local part of an email is used since the domain is shared with other users
+func personalTokens(userInputs []string) []string {
+	var tokens []string
+	for _, input := range userInputs {
+		if at := strings.LastIndex(input, "@"); at >= 0 {
+			input = input[:at]
+		}
+		fields := strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, field := range fields {
+			if utf8.RuneCountInString(field) >= 3 {
+				tokens = append(tokens, field)
+			}
+		}
+	}
+	return tokens
+}
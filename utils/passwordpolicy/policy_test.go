@@ -0,0 +1,107 @@
+package passwordpolicy
+
+import (
+	"emailnotifl3n/app/config"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func rules(err error) []string {
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) {
+		return nil
+	}
+	var result []string
+	for _, v := range policyErr.Violations {
+		result = append(result, v.Rule)
+	}
+	return result
+}
+
+func TestValidateRules(t *testing.T) {
+	p := New(&config.AppConfig{
+		PASSWORD_MIN_LENGTH:     10,
+		PASSWORD_MIN_CLASSES:    3,
+		PASSWORD_CHECK_PERSONAL: true,
+		PASSWORD_MIN_SCORE:      3,
+	})
+
+	tests := []struct {
+		name     string
+		password string
+		want     []string
+	}{
+		{"strong", "Tr0mbone-Galaxy-Ferret", nil},
+		{"too short", "Xk9#mQ2", []string{RuleMinLength}},
+		{"one class", "correcthorsebatterystaple", []string{RuleCharClasses}},
+		{"common word", "Password1234", []string{RuleStrengthScore}},
+		{"keyboard run", "Qwertyuiop123", []string{RuleStrengthScore}},
+		{"name", "Budi-Santoso-99", []string{RulePersonalInfo}},
+		{"email local part", "xBudiS77#Kite", []string{RulePersonalInfo}},
+		{"everything", "abc", []string{RuleMinLength, RuleCharClasses, RuleStrengthScore}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Validate(tt.password, "budis77@mailhost.co.id", "Budi Santoso")
+			if got := rules(err); !slices.Equal(got, tt.want) {
+				t.Fatalf("Validate(%q) rules = %v, want %v", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateIgnoresEmailDomain(t *testing.T) {
+	p := New(&config.AppConfig{PASSWORD_CHECK_PERSONAL: true})
+
+	// the domain is shared with every other user of the provider
+	if err := p.Validate("Mailhost-Rocket-42", "budis77@mailhost.co.id"); err != nil {
+		t.Fatalf("password with the email domain rejected: %v", err)
+	}
+	if got := rules(p.Validate("Budis77-Rocket", "budis77@mailhost.co.id")); !slices.Equal(got, []string{RulePersonalInfo}) {
+		t.Fatalf("password with the email local part rules = %v", got)
+	}
+}
+
+func TestValidateDisabledRules(t *testing.T) {
+	p := New(&config.AppConfig{})
+	if err := p.Validate("a", "a@example.com"); err != nil {
+		t.Fatalf("zero config rejected a password: %v", err)
+	}
+}
+
+func TestPolicyErrorAdd(t *testing.T) {
+	err := &PolicyError{}
+	err.Add(RuleBreached, "password pernah bocor")
+	err.Add(RuleReused, "password pernah dipakai")
+	if err.Error() != "password pernah bocor, password pernah dipakai" {
+		t.Fatalf("Error() = %q", err.Error())
+	}
+}
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		password string
+		max      int
+		min      int
+	}{
+		{"password", 0, 0},
+		{"123456", 0, 0},
+		{"qwertyuiop", 1, 0},
+		{"P@ssw0rd", 1, 0},
+		{"aaaaaaaaaaaa", 1, 0},
+		{"abcdefgh2024", 2, 0},
+		{"Tr0mbone-Galaxy-Ferret", 4, 4},
+		{"q8#Lz!2vRw9@", 4, 4},
+	}
+	for _, tt := range tests {
+		if got := Score(tt.password); got < tt.min || got > tt.max {
+			t.Errorf("Score(%q) = %d, want %d..%d", tt.password, got, tt.min, tt.max)
+		}
+	}
+
+	// words of the account are as cheap as common passwords
+	if Score("santoso", "santoso") >= Score("santoso") {
+		t.Error("user input did not lower the score")
+	}
+}
@@ -0,0 +1,235 @@
+package passwordpolicy
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// strength estimation in the style of zxcvbn: the password is split into the cheapest
+// sequence of known patterns and brute forced characters, the number of guesses an
+// attacker needs for that sequence is mapped to a score from 0 to 4
+
+// passwords longer than this are scored by brute force only after this point
+const maxScoredLength = 64
+
+var leetSubstitutions = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '9': 'g',
+	'@': 'a', '$': 's', '!': 'i', '+': 't',
+}
+
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm", "qazwsxedc"}
+
+// commonPasswords ordered by how often they are used, the index is the rank
+var commonPasswords = []string{
+	"password", "123456", "qwerty", "admin", "letmein", "welcome", "iloveyou", "monkey",
+	"dragon", "login", "master", "sunshine", "princess", "football", "baseball", "shadow",
+	"superman", "michael", "jessica", "charlie", "trustno", "hello", "freedom", "whatever",
+	"starwars", "computer", "secret", "summer", "winter", "spring", "autumn", "love",
+	"money", "soccer", "hockey", "batman", "killer", "pepper", "ginger", "cookie",
+	"cheese", "flower", "internet", "service", "banana", "orange", "apple", "chocolate",
+	"samsung", "google", "facebook", "indonesia", "jakarta", "rahasia", "sayang", "cinta",
+	"bismillah", "kucing", "anjing", "merdeka", "garuda", "bandung", "surabaya", "test",
+	"user", "guest", "root", "pass", "changeme", "default", "access", "mustang",
+	"ninja", "jordan", "hunter", "ranger", "buster", "thomas", "robert", "daniel",
+	"andrew", "joshua", "matrix", "silver", "golden", "purple", "family", "friend",
+	"beautiful", "angel", "lovely", "qwertyuiop", "asdfgh", "zxcvbn", "abcdef", "passwd",
+}
+
+var commonRanks = func() map[string]int {
+	ranks := make(map[string]int, len(commonPasswords))
+	for i, v := range commonPasswords {
+		ranks[v] = i + 1
+	}
+	return ranks
+}()
+
+// Score returns 0 (too guessable) to 4 (very unguessable), userInputs are words
+// of the account like its email and name that count as well known
+func Score(password string, userInputs ...string) int {
+	guesses := log10Guesses(password, userInputs)
+	switch {
+	case guesses < 3:
+		return 0
+	case guesses < 6:
+		return 1
+	case guesses < 8:
+		return 2
+	case guesses < 10:
+		return 3
+	}
+	return 4
+}
+
+// log10Guesses returns the log10 of the guesses needed for the cheapest way to build password
+func log10Guesses(password string, userInputs []string) float64 {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return 0
+	}
+
+	bruteForce := math.Log10(float64(cardinality(runes)))
+	extra := 0.0
+	if len(runes) > maxScoredLength {
+		extra = bruteForce * float64(len(runes)-maxScoredLength)
+		runes = runes[:maxScoredLength]
+	}
+
+	lower := []rune(strings.ToLower(string(runes)))
+	plain := make([]rune, len(lower))
+	for i, r := range lower {
+		if sub, ok := leetSubstitutions[r]; ok {
+			plain[i] = sub
+		} else {
+			plain[i] = r
+		}
+	}
+
+	inputs := map[string]bool{}
+	for _, v := range userInputs {
+		inputs[strings.ToLower(v)] = true
+	}
+
+	// best[i] holds the cheapest guesses for the first i characters
+	best := make([]float64, len(runes)+1)
+	for end := 1; end <= len(runes); end++ {
+		best[end] = best[end-1] + bruteForce
+		for start := 0; start <= end-3; start++ {
+			cost, ok := patternGuesses(runes[start:end], lower[start:end], plain[start:end], inputs)
+			if ok && best[start]+cost < best[end] {
+				best[end] = best[start] + cost
+			}
+		}
+	}
+	return best[len(runes)] + extra
+}
+
+// patternGuesses returns the log10 guesses of a known pattern matching the whole part
+func patternGuesses(original, lower, plain []rune, inputs map[string]bool) (float64, bool) {
+	word := string(plain)
+	if inputs[string(lower)] || inputs[word] {
+		return variations(original, lower, plain), true
+	}
+	if rank, ok := commonRanks[string(lower)]; ok {
+		return math.Log10(float64(rank)) + variations(original, lower, plain), true
+	}
+	if rank, ok := commonRanks[word]; ok {
+		return math.Log10(float64(rank)) + variations(original, lower, plain), true
+	}
+
+	if isRepeat(lower) {
+		return math.Log10(float64(cardinality(lower[:1]) * len(lower))), true
+	}
+	if isSequence(lower) || isKeyboardRun(string(lower)) {
+		return math.Log10(float64(26 * len(lower))), true
+	}
+	if isYear(lower) {
+		return math.Log10(150), true
+	}
+	return 0, false
+}
+
+// variations prices upper case letters and leet substitutions of a dictionary word
+func variations(original, lower, plain []rune) float64 {
+	result := 0.0
+	if string(original) != string(lower) {
+		upper := strings.ToUpper(string(original)) == string(original)
+		first := unicode.IsUpper(original[0]) && string(original[1:]) == string(lower[1:])
+		if upper || first {
+			result += math.Log10(2)
+		} else {
+			result += 1
+		}
+	}
+	if string(plain) != string(lower) {
+		result += math.Log10(4)
+	}
+	return result
+}
+
+func cardinality(runes []rune) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < 128:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	result := 0
+	if lower {
+		result += 26
+	}
+	if upper {
+		result += 26
+	}
+	if digit {
+		result += 10
+	}
+	if symbol {
+		result += 33
+	}
+	if other {
+		result += 100
+	}
+	return result
+}
+
+func isRepeat(runes []rune) bool {
+	for _, r := range runes[1:] {
+		if r != runes[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// isSequence matches runs like abcd, 9876 or 2468
+func isSequence(runes []rune) bool {
+	step := runes[1] - runes[0]
+	if step == 0 || step > 2 || step < -2 {
+		return false
+	}
+	for i := 2; i < len(runes); i++ {
+		if runes[i]-runes[i-1] != step {
+			return false
+		}
+	}
+	return true
+}
+
+func isKeyboardRun(s string) bool {
+	if len(s) < 4 {
+		return false
+	}
+	for _, row := range keyboardRows {
+		if strings.Contains(row, s) || strings.Contains(reverse(row), s) {
+			return true
+		}
+	}
+	return false
+}
+
+func isYear(runes []rune) bool {
+	if len(runes) != 4 {
+		return false
+	}
+	s := string(runes)
+	return (strings.HasPrefix(s, "19") || strings.HasPrefix(s, "20")) && strings.Trim(s, "0123456789") == ""
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
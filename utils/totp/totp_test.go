@@ -0,0 +1,99 @@
+package totp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B secret, the expected codes are the last 6 of the 8 digit SHA1 vectors
+var rfcSecret = encoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestValidateRFCVectors(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		step, ok := Validate(rfcSecret, tt.code, time.Unix(tt.unix, 0))
+		if !ok {
+			t.Errorf("Validate(%d, %s) rejected", tt.unix, tt.code)
+			continue
+		}
+		if step != tt.unix/Period {
+			t.Errorf("Validate(%d) step = %d, want %d", tt.unix, step, tt.unix/Period)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	at := time.Unix(1234567890, 0)
+	code := generate([]byte("12345678901234567890"), at.Unix()/Period)
+
+	for _, offset := range []time.Duration{-Period * time.Second, 0, Period * time.Second} {
+		if _, ok := Validate(rfcSecret, code, at.Add(offset)); !ok {
+			t.Errorf("code rejected with %s drift", offset)
+		}
+	}
+	for _, offset := range []time.Duration{-2 * Period * time.Second, 2 * Period * time.Second} {
+		if _, ok := Validate(rfcSecret, code, at.Add(offset)); ok {
+			t.Errorf("code accepted with %s drift", offset)
+		}
+	}
+}
+
+func TestValidateRejectsMalformed(t *testing.T) {
+	at := time.Unix(59, 0)
+	for _, tt := range []struct{ secret, code string }{
+		{rfcSecret, "28708"},
+		{rfcSecret, "2870820"},
+		{rfcSecret, "000000"},
+		{"not base32!", "287082"},
+	} {
+		if _, ok := Validate(tt.secret, tt.code, at); ok {
+			t.Errorf("Validate(%q, %q) accepted", tt.secret, tt.code)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := encoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("secret is not base32: %v", err)
+	}
+	if len(key) != 20 {
+		t.Fatalf("secret has %d bytes, want 20", len(key))
+	}
+
+	other, _ := GenerateSecret()
+	if other == secret {
+		t.Fatal("two secrets are equal")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Example", "user@example.com", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(uri, "otpauth://totp/Example:user@example.com?") {
+		t.Fatalf("unexpected uri %s", uri)
+	}
+
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	if query.Get("secret") != "JBSWY3DPEHPK3PXP" || query.Get("issuer") != "Example" || query.Get("digits") != "6" || query.Get("period") != "30" {
+		t.Fatalf("unexpected parameters %v", query)
+	}
+}
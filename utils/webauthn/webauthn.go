@@ -0,0 +1,248 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"emailnotifl3n/app/config"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// how long the browser prompt stays open, the stored challenge lives as long
+const Timeout = 5 * time.Minute
+
+// authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+// Credential is the public part of a passkey that has to be stored
+type Credential struct {
+	ID        []byte
+	PublicKey []byte
+	SignCount uint32
+}
+
+// RelyingParty identifies this service to authenticators
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+}
+
+type WebAuthnInterface interface {
+	RelyingParty() RelyingParty
+	NewChallenge() (string, error)
+	VerifyRegistration(challenge string, clientDataJSON, attestationObject []byte) (*Credential, error)
+	VerifyAssertion(challenge string, credential Credential, clientDataJSON, authenticatorData, signature []byte) (uint32, error)
+}
+
+type webAuthn struct {
+	rp RelyingParty
+}
+
+func New() WebAuthnInterface {
+	return NewWithRelyingParty(RelyingParty{
+		ID:      config.WEBAUTHN_RP_ID,
+		Name:    config.WEBAUTHN_RP_NAME,
+		Origins: config.WEBAUTHN_ORIGINS,
+	})
+}
+
+func NewWithRelyingParty(rp RelyingParty) WebAuthnInterface {
+	return &webAuthn{rp: rp}
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// RelyingParty implements WebAuthnInterface.
+func (w *webAuthn) RelyingParty() RelyingParty {
+	return w.rp
+}
+
+// NewChallenge implements WebAuthnInterface.
+func (w *webAuthn) NewChallenge() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// VerifyRegistration implements WebAuthnInterface.
+// Attestation statements are not checked, the service asks for "none"
+// attestation and only trusts the key the authenticator hands over.
+func (w *webAuthn) VerifyRegistration(challenge string, clientDataJSON, attestationObject []byte) (*Credential, error) {
+	err := w.verifyClientData(clientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, err
+	}
+	attestation, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, errors.New("webauthn: invalid attestation object")
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("webauthn: missing authenticator data")
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	err = w.verifyAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.flags&flagAttestedData == 0 || authData.publicKey == nil {
+		return nil, errors.New("webauthn: no attested credential data")
+	}
+
+	// reject keys we would not be able to verify at login
+	if _, err := parsePublicKey(authData.publicKey); err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		ID:        authData.credentialID,
+		PublicKey: authData.publicKey,
+		SignCount: authData.signCount,
+	}, nil
+}
+
+// VerifyAssertion implements WebAuthnInterface and returns the new signature counter.
+func (w *webAuthn) VerifyAssertion(challenge string, credential Credential, clientDataJSON, rawAuthData, signature []byte) (uint32, error) {
+	err := w.verifyClientData(clientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+	err = w.verifyAuthenticatorData(authData)
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := parsePublicKey(credential.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	message := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	err = key.verify(message, signature)
+	if err != nil {
+		return 0, err
+	}
+
+	// a counter that does not move forward points to a cloned authenticator
+	if authData.signCount != 0 || credential.SignCount != 0 {
+		if authData.signCount <= credential.SignCount {
+			return 0, errors.New("webauthn: signature counter did not increase")
+		}
+	}
+	return authData.signCount, nil
+}
+
+func (w *webAuthn) verifyClientData(raw []byte, ceremony, challenge string) error {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("webauthn: invalid client data: %w", err)
+	}
+
+	if data.Type != ceremony {
+		return fmt.Errorf("webauthn: unexpected ceremony %q", data.Type)
+	}
+
+	received := strings.TrimRight(data.Challenge, "=")
+	if challenge == "" || subtle.ConstantTimeCompare([]byte(received), []byte(challenge)) != 1 {
+		return errors.New("webauthn: challenge mismatch")
+	}
+
+	for _, origin := range w.rp.Origins {
+		if strings.TrimSpace(origin) == data.Origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("webauthn: origin %q is not allowed", data.Origin)
+}
+
+func (w *webAuthn) verifyAuthenticatorData(authData *authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(w.rp.ID))
+	if !bytes.Equal(authData.rpIDHash, rpIDHash[:]) {
+		return errors.New("webauthn: relying party id mismatch")
+	}
+	if authData.flags&flagUserPresent == 0 {
+		return errors.New("webauthn: user not present")
+	}
+	// a passkey login replaces the password and the second factor,
+	// so the authenticator has to check a pin or biometric as well
+	if authData.flags&flagUserVerified == 0 {
+		return errors.New("webauthn: user not verified")
+	}
+	return nil
+}
+
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, errors.New("webauthn: authenticator data too short")
+	}
+
+	result := &authenticatorData{
+		rpIDHash:  b[:32],
+		flags:     b[32],
+		signCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	if result.flags&flagAttestedData == 0 {
+		return result, nil
+	}
+
+	rest := b[37:]
+	// aaguid (16) followed by the credential id length (2)
+	if len(rest) < 18 {
+		return nil, errors.New("webauthn: attested credential data too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return nil, errors.New("webauthn: credential id too short")
+	}
+	result.credentialID = append([]byte{}, rest[:idLen]...)
+	rest = rest[idLen:]
+
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, err
+	}
+	result.publicKey = append([]byte{}, rest[:len(rest)-len(after)]...)
+	return result, nil
+}
@@ -0,0 +1,311 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const (
+	testRPID   = "example.com"
+	testOrigin = "https://app.example.com"
+)
+
+func testRelyingParty() WebAuthnInterface {
+	return NewWithRelyingParty(RelyingParty{ID: testRPID, Name: "Example", Origins: []string{testOrigin}})
+}
+
+// cborPair keeps map entries in the order they are written
+type cborPair struct {
+	key   any
+	value any
+}
+
+func encodeCBOR(v any) []byte {
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []cborPair:
+		out := cborHead(5, uint64(len(v)))
+		for _, pair := range v {
+			out = append(out, encodeCBOR(pair.key)...)
+			out = append(out, encodeCBOR(pair.value)...)
+		}
+		return out
+	}
+	panic("cbor: unsupported test value")
+}
+
+func cborHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+	}
+	return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(arg))
+}
+
+// softAuthenticator plays the part of a platform authenticator holding one credential
+type softAuthenticator struct {
+	t            *testing.T
+	rpID         string
+	credentialID []byte
+	signCount    uint32
+	ecKey        *ecdsa.PrivateKey
+	edKey        ed25519.PrivateKey
+}
+
+func newSoftAuthenticator(t *testing.T, alg int) *softAuthenticator {
+	t.Helper()
+	a := &softAuthenticator{t: t, rpID: testRPID, credentialID: make([]byte, 16)}
+	if _, err := rand.Read(a.credentialID); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	switch alg {
+	case AlgES256:
+		a.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		_, a.edKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		t.Fatalf("unsupported algorithm %d", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	if a.ecKey != nil {
+		return encodeCBOR([]cborPair{
+			{coseKty, ktyEC2},
+			{coseAlg, AlgES256},
+			{coseCrv, crvP256},
+			{coseX, a.ecKey.X.FillBytes(make([]byte, 32))},
+			{coseY, a.ecKey.Y.FillBytes(make([]byte, 32))},
+		})
+	}
+	return encodeCBOR([]cborPair{
+		{coseKty, ktyOKP},
+		{coseAlg, AlgEdDSA},
+		{coseCrv, crvEd25519},
+		{coseX, []byte(a.edKey.Public().(ed25519.PublicKey))},
+	})
+}
+
+func (a *softAuthenticator) authData(flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	out := append([]byte{}, rpIDHash[:]...)
+	out = append(out, flags)
+	out = binary.BigEndian.AppendUint32(out, a.signCount)
+	if attested {
+		out = append(out, make([]byte, 16)...)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(a.credentialID)))
+		out = append(out, a.credentialID...)
+		out = append(out, a.coseKey()...)
+	}
+	return out
+}
+
+func clientDataJSON(t *testing.T, ceremony, challenge, origin string) []byte {
+	t.Helper()
+	raw, err := json.Marshal(clientData{Type: ceremony, Challenge: challenge, Origin: origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func (a *softAuthenticator) create(challenge, origin string, flags byte) (clientData, attestationObject []byte) {
+	clientData = clientDataJSON(a.t, "webauthn.create", challenge, origin)
+	attestationObject = encodeCBOR([]cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", a.authData(flags|flagAttestedData, true)},
+	})
+	return clientData, attestationObject
+}
+
+func (a *softAuthenticator) get(challenge, origin string, flags byte) (clientData, authData, signature []byte) {
+	a.signCount++
+	clientData = clientDataJSON(a.t, "webauthn.get", challenge, origin)
+	authData = a.authData(flags, false)
+
+	clientDataHash := sha256.Sum256(clientData)
+	message := append(append([]byte{}, authData...), clientDataHash[:]...)
+	if a.ecKey != nil {
+		digest := sha256.Sum256(message)
+		var err error
+		signature, err = ecdsa.SignASN1(rand.Reader, a.ecKey, digest[:])
+		if err != nil {
+			a.t.Fatal(err)
+		}
+	} else {
+		signature = ed25519.Sign(a.edKey, message)
+	}
+	return clientData, authData, signature
+}
+
+func register(t *testing.T, w WebAuthnInterface, a *softAuthenticator) *Credential {
+	t.Helper()
+	challenge, err := w.NewChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientData, attestation := a.create(challenge, testOrigin, flagUserPresent|flagUserVerified)
+	credential, err := w.VerifyRegistration(challenge, clientData, attestation)
+	if err != nil {
+		t.Fatalf("VerifyRegistration: %v", err)
+	}
+	return credential
+}
+
+func TestRegistrationAndAssertion(t *testing.T) {
+	for name, alg := range map[string]int{"ES256": AlgES256, "Ed25519": AlgEdDSA} {
+		t.Run(name, func(t *testing.T) {
+			w := testRelyingParty()
+			a := newSoftAuthenticator(t, alg)
+
+			credential := register(t, w, a)
+			if string(credential.ID) != string(a.credentialID) {
+				t.Fatalf("credential id = %x, want %x", credential.ID, a.credentialID)
+			}
+
+			for i := 0; i < 2; i++ {
+				challenge, _ := w.NewChallenge()
+				clientData, authData, signature := a.get(challenge, testOrigin, flagUserPresent|flagUserVerified)
+				signCount, err := w.VerifyAssertion(challenge, *credential, clientData, authData, signature)
+				if err != nil {
+					t.Fatalf("VerifyAssertion: %v", err)
+				}
+				if signCount != a.signCount {
+					t.Fatalf("sign count = %d, want %d", signCount, a.signCount)
+				}
+				credential.SignCount = signCount
+			}
+		})
+	}
+}
+
+func TestRegistrationRejected(t *testing.T) {
+	w := testRelyingParty()
+	challenge, _ := w.NewChallenge()
+
+	tests := []struct {
+		name      string
+		challenge string
+		origin    string
+		rpID      string
+		flags     byte
+		want      string
+	}{
+		{"challenge mismatch", "other-challenge", testOrigin, testRPID, flagUserPresent | flagUserVerified, "challenge mismatch"},
+		{"origin mismatch", challenge, "https://evil.example.net", testRPID, flagUserPresent | flagUserVerified, "origin"},
+		{"relying party mismatch", challenge, testOrigin, "evil.example.net", flagUserPresent | flagUserVerified, "relying party id mismatch"},
+		{"user not verified", challenge, testOrigin, testRPID, flagUserPresent, "user not verified"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newSoftAuthenticator(t, AlgES256)
+			a.rpID = tt.rpID
+			clientData, attestation := a.create(tt.challenge, tt.origin, tt.flags)
+			_, err := w.VerifyRegistration(challenge, clientData, attestation)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssertionRejected(t *testing.T) {
+	w := testRelyingParty()
+	a := newSoftAuthenticator(t, AlgES256)
+	credential := register(t, w, a)
+
+	t.Run("challenge mismatch", func(t *testing.T) {
+		challenge, _ := w.NewChallenge()
+		clientData, authData, signature := a.get("other-challenge", testOrigin, flagUserPresent|flagUserVerified)
+		_, err := w.VerifyAssertion(challenge, *credential, clientData, authData, signature)
+		if err == nil || !strings.Contains(err.Error(), "challenge mismatch") {
+			t.Fatalf("err = %v, want challenge mismatch", err)
+		}
+	})
+
+	t.Run("origin mismatch", func(t *testing.T) {
+		challenge, _ := w.NewChallenge()
+		clientData, authData, signature := a.get(challenge, "https://evil.example.net", flagUserPresent|flagUserVerified)
+		_, err := w.VerifyAssertion(challenge, *credential, clientData, authData, signature)
+		if err == nil || !strings.Contains(err.Error(), "origin") {
+			t.Fatalf("err = %v, want origin error", err)
+		}
+	})
+
+	t.Run("user not verified", func(t *testing.T) {
+		challenge, _ := w.NewChallenge()
+		clientData, authData, signature := a.get(challenge, testOrigin, flagUserPresent)
+		_, err := w.VerifyAssertion(challenge, *credential, clientData, authData, signature)
+		if err == nil || !strings.Contains(err.Error(), "user not verified") {
+			t.Fatalf("err = %v, want user not verified", err)
+		}
+	})
+
+	t.Run("signature by another key", func(t *testing.T) {
+		other := newSoftAuthenticator(t, AlgES256)
+		challenge, _ := w.NewChallenge()
+		clientData, authData, signature := other.get(challenge, testOrigin, flagUserPresent|flagUserVerified)
+		_, err := w.VerifyAssertion(challenge, *credential, clientData, authData, signature)
+		if err == nil || !strings.Contains(err.Error(), "invalid signature") {
+			t.Fatalf("err = %v, want invalid signature", err)
+		}
+	})
+
+	t.Run("sign count not increasing", func(t *testing.T) {
+		stored := *credential
+		stored.SignCount = 10
+		a.signCount = 9 // the next assertion reports 10 again
+		challenge, _ := w.NewChallenge()
+		clientData, authData, signature := a.get(challenge, testOrigin, flagUserPresent|flagUserVerified)
+		_, err := w.VerifyAssertion(challenge, stored, clientData, authData, signature)
+		if err == nil || !strings.Contains(err.Error(), "signature counter did not increase") {
+			t.Fatalf("err = %v, want counter error", err)
+		}
+	})
+}
+
+func TestAssertionWithoutCounter(t *testing.T) {
+	// authenticators that never count report zero on every assertion
+	w := testRelyingParty()
+	a := newSoftAuthenticator(t, AlgEdDSA)
+	credential := register(t, w, a)
+
+	for i := 0; i < 2; i++ {
+		a.signCount = ^uint32(0) // wraps to zero in get
+		challenge, _ := w.NewChallenge()
+		clientData, authData, signature := a.get(challenge, testOrigin, flagUserPresent|flagUserVerified)
+		signCount, err := w.VerifyAssertion(challenge, *credential, clientData, authData, signature)
+		if err != nil {
+			t.Fatalf("VerifyAssertion: %v", err)
+		}
+		if signCount != 0 {
+			t.Fatalf("sign count = %d, want 0", signCount)
+		}
+	}
+}